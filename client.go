@@ -0,0 +1,266 @@
+package usftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultRetries is the number of times a Client re-establishes its Session for one request
+	DefaultRetries = 3
+	// DefaultMinBackoff is the delay before the first attempt to re-establish a Session
+	DefaultMinBackoff = 100 * time.Millisecond
+	// DefaultMaxBackoff limits the delay between attempts to re-establish a Session
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// Client is a Session which is re-established when the connection is lost. Idempotent requests
+// failing with ErrConnectionLost are retried on the new Session, with an exponential backoff
+// between attempts to connect.
+type Client struct {
+	dial       func() (*Session, error)
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mtx     sync.Mutex
+	session *Session
+	closed  bool
+}
+
+// WithRetries sets the number of times a Client re-establishes its Session for one request,
+// the default is DefaultRetries
+func WithRetries(retries int) DialOption {
+	return func(o *dialOptions) {
+		o.retries = retries
+	}
+}
+
+// WithBackoff sets the delay before the first attempt to re-establish a Session, doubling for
+// each further attempt up to limit
+func WithBackoff(initial time.Duration, limit time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.minBackoff = initial
+		o.maxBackoff = limit
+	}
+}
+
+// NewClient returns a Client on the Session returned by dial, which is called again whenever the
+// connection is lost. Only WithRetries and WithBackoff apply from opts.
+func NewClient(dial func() (*Session, error), opts ...DialOption) (*Client, error) {
+	o := newDialOptions("", opts)
+	c := &Client{dial: dial, retries: o.retries, minBackoff: o.minBackoff, maxBackoff: o.maxBackoff}
+	if c.retries == 0 {
+		c.retries = DefaultRetries
+	}
+	if c.minBackoff == 0 {
+		c.minBackoff = DefaultMinBackoff
+	}
+	if c.maxBackoff == 0 {
+		c.maxBackoff = DefaultMaxBackoff
+	}
+	s, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	c.session = s
+	return c, nil
+}
+
+// DialClient returns a Client which connects with Dial and NewSession, see WithSessionOptions
+func DialClient(user string, host string, port int, privateKeyPath string, hostKeyCallback ssh.HostKeyCallback, opts ...DialOption) (*Client, error) {
+	return NewClient(func() (*Session, error) {
+		return dialSession(user, host, port, privateKeyPath, hostKeyCallback, opts...)
+	}, opts...)
+}
+
+// Session returns the current Session, re-establishing it if the connection has been lost
+func (c *Client) Session() (*Session, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		return nil, ErrSessionClosed
+	}
+	if c.session == nil {
+		s, err := c.dial()
+		if err != nil {
+			return nil, err
+		}
+		c.session = s
+	}
+	return c.session, nil
+}
+
+// drop closes s when it is still the current Session, so the next request re-establishes it
+func (c *Client) drop(s *Session) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.session == s {
+		_ = s.Close()
+		c.session = nil
+	}
+}
+
+// do runs op, retrying on a new Session while it fails with ErrConnectionLost or a new Session
+// can not be established
+func (c *Client) do(op func(s *Session) error) error {
+	backoff := c.minBackoff
+	for attempt := 0; ; attempt++ {
+		s, err := c.Session()
+		if errors.Is(err, ErrSessionClosed) {
+			return err
+		}
+		if err == nil {
+			if err = op(s); !errors.Is(err, ErrConnectionLost) {
+				return err
+			}
+			c.drop(s)
+		}
+		if attempt >= c.retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, c.maxBackoff)
+	}
+}
+
+func (c *Client) Ls(path string) ([]*NameRespFile, error) {
+	var names []*NameRespFile
+	err := c.do(func(s *Session) error {
+		var err error
+		names, err = s.Ls(path)
+		return err
+	})
+	return names, err
+}
+
+func (c *Client) Find(path string) ([]*NameRespFile, error) {
+	var files []*NameRespFile
+	err := c.do(func(s *Session) error {
+		var err error
+		files, err = s.Find(path)
+		return err
+	})
+	return files, err
+}
+
+func (c *Client) Stat(path string) (Attrs, error) {
+	var attrs Attrs
+	err := c.do(func(s *Session) error {
+		var err error
+		attrs, err = s.Stat(path)
+		return err
+	})
+	return attrs, err
+}
+
+// Get writes the contents of from to out. After a reconnect the transfer continues from the
+// offset already written.
+func (c *Client) Get(from string, out io.Writer, opts ...TransferOption) error {
+	return c.GetRange(from, 0, -1, out, opts...)
+}
+
+// GetRange writes length bytes of from starting at offset to out, or until the end of the file
+// when length is negative. After a reconnect the transfer continues from the offset already
+// written.
+func (c *Client) GetRange(from string, offset int64, length int64, out io.Writer, opts ...TransferOption) error {
+	if offset < 0 {
+		return fmt.Errorf("negative offset %d", offset)
+	}
+	t := newTransfer(from, newTransferOptions(opts))
+	defer t.finish()
+	if t.progress != nil {
+		if err := c.do(func(s *Session) error {
+			return s.statTotal(t, uint64(offset), length)
+		}); err != nil {
+			return err
+		}
+	}
+	var written uint64
+	return c.do(func(s *Session) error {
+		remaining := length
+		if length >= 0 {
+			remaining -= int64(written)
+		}
+		n, err := s.get(from, uint64(offset)+written, remaining, out, t)
+		written += n
+		return err
+	})
+}
+
+// ResumePut uploads the local file localPath to remote, see Session.ResumePut. After a
+// reconnect the upload continues from the size of remote.
+func (c *Client) ResumePut(localPath string, remote string, opts ...TransferOption) error {
+	return c.do(func(s *Session) error {
+		return s.ResumePut(localPath, remote, opts...)
+	})
+}
+
+// Download copies remote to the local file localPath, see Session.Download. After a reconnect
+// the download starts again.
+func (c *Client) Download(remote string, localPath string, opts ...TransferOption) error {
+	return c.do(func(s *Session) error {
+		return s.Download(remote, localPath, opts...)
+	})
+}
+
+// DownloadDir copies the directory remote to the local directory localPath, see
+// Session.DownloadDir. After a reconnect the download starts again, so WithSkipUnchanged avoids
+// copying files already completed.
+func (c *Client) DownloadDir(remote string, localPath string, opts ...TransferOption) error {
+	return c.do(func(s *Session) error {
+		return s.DownloadDir(remote, localPath, opts...)
+	})
+}
+
+// UploadDir copies the local directory localPath to the directory remote, see
+// Session.UploadDir. After a reconnect the upload starts again.
+func (c *Client) UploadDir(localPath string, remote string, opts ...TransferOption) error {
+	return c.do(func(s *Session) error {
+		return s.UploadDir(localPath, remote, opts...)
+	})
+}
+
+// SyncDownload makes the local directory localPath a mirror of the directory remote, see
+// Session.SyncDownload. After a reconnect the sync is planned again, so files already copied
+// are not copied again.
+func (c *Client) SyncDownload(remote string, localPath string, opts ...TransferOption) (SyncPlan, error) {
+	var plan SyncPlan
+	err := c.do(func(s *Session) error {
+		var err error
+		plan, err = s.SyncDownload(remote, localPath, opts...)
+		return err
+	})
+	return plan, err
+}
+
+// SyncUpload makes the directory remote a mirror of the local directory localPath, see
+// Session.SyncUpload. After a reconnect the sync is planned again, so files already copied are
+// not copied again.
+func (c *Client) SyncUpload(localPath string, remote string, opts ...TransferOption) (SyncPlan, error) {
+	var plan SyncPlan
+	err := c.do(func(s *Session) error {
+		var err error
+		plan, err = s.SyncUpload(localPath, remote, opts...)
+		return err
+	})
+	return plan, err
+}
+
+// Close closes the current Session. The Client can not be used again.
+func (c *Client) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.closed = true
+	if c.session == nil {
+		return nil
+	}
+	err := c.session.Close()
+	c.session = nil
+	return err
+}
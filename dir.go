@@ -0,0 +1,295 @@
+package usftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultConcurrency is the number of files a directory transfer copies at once
+const DefaultConcurrency = 4
+
+// WithConcurrency sets the number of files a directory transfer copies at once, the default is
+// DefaultConcurrency
+func WithConcurrency(n int) TransferOption {
+	return func(o *transferOptions) {
+		o.concurrency = n
+	}
+}
+
+// WithInclude limits a directory transfer to files matching one of patterns, as for WithExclude.
+// Directories are created whether or not they contain matching files.
+func WithInclude(patterns ...string) TransferOption {
+	return func(o *transferOptions) {
+		o.include = append(o.include, patterns...)
+	}
+}
+
+// WithExclude skips the files and directories of a directory transfer matching one of patterns,
+// using the syntax of path.Match. A pattern is matched against both the slash separated path
+// relative to the directory being transferred and the name, so "*.tmp" matches at any depth.
+func WithExclude(patterns ...string) TransferOption {
+	return func(o *transferOptions) {
+		o.exclude = append(o.exclude, patterns...)
+	}
+}
+
+// dirAttrs is a directory created by a directory transfer, with the attributes to apply once
+// its contents are complete
+type dirAttrs struct {
+	path  string
+	attrs Attrs
+}
+
+// DownloadDir copies the directory remote and everything below it to the local directory
+// localPath, creating directories as needed and copying files concurrently, see
+// WithConcurrency. Each file is written as by Download, and directories are given the
+// permissions and times of the remote directories once their contents are complete. Entries
+// which are neither regular files nor directories, such as symbolic links, are skipped.
+// Progress is reported for each file, and stats are added to for each file.
+func (s *Session) DownloadDir(remote string, localPath string, opts ...TransferOption) error {
+	o := newTransferOptions(opts)
+	if err := o.checkPatterns(); err != nil {
+		return err
+	}
+	o.shared = &sync.Mutex{}
+	attrs, err := s.Stat(remote)
+	if err != nil {
+		return err
+	}
+	if !attrs.Permissions.IsDir() {
+		return &fs.PathError{Op: "download", Path: remote, Err: errors.New("not a directory")}
+	}
+	files, err := s.Find(remote)
+	if err != nil {
+		return err
+	}
+	dirs := []dirAttrs{{path: localPath, attrs: attrs}}
+	if err := os.MkdirAll(localPath, 0755); err != nil {
+		return err
+	}
+
+	eg, ctx := s.workers(o)
+	var visit func(files []*NameRespFile, local string, rel string) error
+	visit = func(files []*NameRespFile, local string, rel string) error {
+		for _, file := range files {
+			if file.Filename == "." || file.Filename == ".." {
+				continue
+			}
+			if err := checkName(file); err != nil {
+				return err
+			}
+			from := path.Join(file.Path, file.Filename)
+			to := filepath.Join(local, file.Filename)
+			name := path.Join(rel, file.Filename)
+			if o.skip(name, file.Attrs.Permissions.IsDir()) {
+				continue
+			}
+			switch {
+			case file.Attrs.Permissions.IsDir():
+				if err := os.MkdirAll(to, 0755); err != nil {
+					return err
+				}
+				dirs = append(dirs, dirAttrs{path: to, attrs: file.Attrs})
+				if err := visit(file.Children, to, name); err != nil {
+					return err
+				}
+			case file.Attrs.Permissions.IsRegular():
+				attrs := file.Attrs
+				eg.Go(func() error {
+					if ctx.Err() != nil {
+						return nil
+					}
+					t := newTransfer(from, o)
+					defer t.finish()
+					return s.download(from, to, attrs, t)
+				})
+			}
+		}
+		return nil
+	}
+	if err := visit(files, localPath, ""); err != nil {
+		_ = eg.Wait()
+		return err
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	// children are listed after their parents, so apply in reverse to set a directory's times
+	// after anything within it is changed
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := setLocalAttrs(dirs[i].path, dirs[i].attrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UploadDir copies the local directory localPath and everything below it to the directory
+// remote, creating directories with MkdirAll and copying files concurrently, see
+// WithConcurrency. Each file is written as by Put, including WithAtomic, and files and
+// directories are given the permissions and times of the local ones with Setstat once their
+// contents are complete. Entries which are neither regular files nor directories, such as
+// symbolic links, are skipped. Progress is reported for each file, and stats are added to for
+// each file.
+func (s *Session) UploadDir(localPath string, remote string, opts ...TransferOption) error {
+	o := newTransferOptions(opts)
+	if err := o.checkPatterns(); err != nil {
+		return err
+	}
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &fs.PathError{Op: "upload", Path: localPath, Err: errors.New("not a directory")}
+	}
+	o.shared = &sync.Mutex{}
+	var dirs []dirAttrs
+	eg, ctx := s.workers(o)
+	err = filepath.WalkDir(localPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		to := path.Join(remote, name)
+		if name != "." && o.skip(name, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		attrs := FileInfoAttrs(fi)
+		// the size is set by the upload, and would truncate or extend the file
+		attrs.Flags &^= SSH_FILEXFER_ATTR_SIZE
+		if d.IsDir() {
+			if err := s.MkdirAll(to, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dirAttrs{path: to, attrs: attrs})
+			return nil
+		}
+		eg.Go(func() error {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return s.uploadFile(p, to, attrs, newTransfer(to, o))
+		})
+		return nil
+	})
+	if err != nil {
+		_ = eg.Wait()
+		return err
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := s.Setstat(dirs[i].path, dirs[i].attrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFile uploads the local file localPath to remote and sets its attributes to attrs
+func (s *Session) uploadFile(localPath string, remote string, attrs Attrs, t *transfer) error {
+	defer t.finish()
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	t.total = readerSize(f)
+	if err := s.upload(f, remote, t); err != nil {
+		return err
+	}
+	t.request()
+	return s.Setstat(remote, attrs)
+}
+
+// checkPatterns validates the patterns given to WithInclude and WithExclude
+func (o transferOptions) checkPatterns() error {
+	for _, pattern := range append(o.include, o.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// skip reports whether the entry at the slash separated relative path name is excluded from a
+// directory transfer
+func (o transferOptions) skip(name string, dir bool) bool {
+	if matchAny(o.exclude, name) {
+		return true
+	}
+	return !dir && len(o.include) > 0 && !matchAny(o.include, name)
+}
+
+// matchAny reports whether the path name, or its last element, matches one of patterns
+func matchAny(patterns []string, name string) bool {
+	base := path.Base(name)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkName rejects a listed file whose name would leave its directory when joined to a local
+// path
+func checkName(file *NameRespFile) error {
+	if !filepath.IsLocal(file.Filename) || strings.Contains(file.Filename, "/") {
+		return fmt.Errorf("%s: invalid file name %q", file.Path, file.Filename)
+	}
+	return nil
+}
+
+// workers returns a group running up to the configured number of transfers at once
+func (s *Session) workers(o transferOptions) (*errgroup.Group, context.Context) {
+	eg, ctx := errgroup.WithContext(s.ctx)
+	n := o.concurrency
+	if n <= 0 {
+		n = DefaultConcurrency
+	}
+	eg.SetLimit(n)
+	return eg, ctx
+}
+
+// setLocalAttrs sets the permissions and times of the local file p from attrs, where present
+func setLocalAttrs(p string, attrs Attrs) error {
+	if attrs.Flags&SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		if err := os.Chmod(p, attrs.Permissions.FsFileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if attrs.Flags&SSH_FILEXFER_ATTR_ACMODTIME != 0 {
+		return os.Chtimes(p, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package usftp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// OverwritePolicy decides whether Download replaces an existing local file
+type OverwritePolicy int
+
+const (
+	// OverwriteAlways replaces an existing file
+	OverwriteAlways OverwritePolicy = iota
+	// OverwriteNever fails with fs.ErrExist when the file exists
+	OverwriteNever
+	// OverwriteIfNewer replaces an existing file only when the remote file was modified later,
+	// otherwise leaving it in place
+	OverwriteIfNewer
+)
+
+// WithOverwrite sets the policy for replacing an existing local file, the default is
+// OverwriteAlways
+func WithOverwrite(policy OverwritePolicy) TransferOption {
+	return func(o *transferOptions) {
+		o.overwrite = policy
+	}
+}
+
+// WithSkipUnchanged leaves an existing local file in place when it has the size and modification
+// time of the remote file
+func WithSkipUnchanged() TransferOption {
+	return func(o *transferOptions) {
+		o.skipUnchanged = true
+	}
+}
+
+// Download copies remote to the local file localPath, setting its permissions and times from
+// the remote attributes. The content is written to a temporary file in the same directory which
+// is renamed into place once complete, so localPath never holds a partial file.
+func (s *Session) Download(remote string, localPath string, opts ...TransferOption) error {
+	t := newTransfer(remote, newTransferOptions(opts))
+	defer t.finish()
+	t.request()
+	attrs, err := s.Stat(remote)
+	if err != nil {
+		return err
+	}
+	return s.download(remote, localPath, attrs, t)
+}
+
+// download copies remote, which has attrs, to localPath
+func (s *Session) download(remote string, localPath string, attrs Attrs, t *transfer) error {
+	if attrs.Permissions.IsDir() {
+		return &fs.PathError{Op: "download", Path: remote, Err: errors.New("is a directory")}
+	}
+	skip, err := skipDownload(localPath, attrs, t.transferOptions)
+	if err != nil || skip {
+		return err
+	}
+	if attrs.Flags&SSH_FILEXFER_ATTR_SIZE != 0 {
+		t.total = attrs.Size
+	}
+
+	// the temporary file must be on the same filesystem for the rename to be atomic, with a
+	// bare filename that is the working directory rather than os.TempDir
+	f, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".*.part")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if err := s.downloadTo(f, remote, attrs, t); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if attrs.Flags&SSH_FILEXFER_ATTR_ACMODTIME != 0 {
+		if err := os.Chtimes(tmp, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, localPath); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// downloadTo writes remote to f, sets its permissions and closes it
+func (s *Session) downloadTo(f *os.File, remote string, attrs Attrs, t *transfer) error {
+	if _, err := s.get(remote, 0, -1, f, t); err != nil {
+		return err
+	}
+	perm := fs.FileMode(0644)
+	if attrs.Flags&SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		perm = attrs.Permissions.FsFileMode().Perm()
+	}
+	if err := f.Chmod(perm); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// skipDownload reports whether an existing localPath should be left in place, or fails when it
+// must not be overwritten
+func skipDownload(localPath string, attrs Attrs, o transferOptions) (bool, error) {
+	fi, err := os.Stat(localPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fi.IsDir() {
+		return false, &fs.PathError{Op: "download", Path: localPath, Err: errors.New("is a directory")}
+	}
+	hasTimes := attrs.Flags&SSH_FILEXFER_ATTR_ACMODTIME != 0
+	mtime := time.Unix(int64(attrs.Mtime), 0)
+	if o.skipUnchanged && attrs.Flags&SSH_FILEXFER_ATTR_SIZE != 0 && hasTimes &&
+		uint64(fi.Size()) == attrs.Size && fi.ModTime().Truncate(time.Second).Equal(mtime) {
+		return true, nil
+	}
+	switch o.overwrite {
+	case OverwriteNever:
+		return false, &fs.PathError{Op: "download", Path: localPath, Err: fs.ErrExist}
+	case OverwriteIfNewer:
+		return !hasTimes || !mtime.After(fi.ModTime()), nil
+	case OverwriteAlways:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown overwrite policy %d", o.overwrite)
+	}
+}
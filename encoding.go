@@ -2,22 +2,67 @@ package usftp
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
-func Uint32(b []byte) (uint32, []byte) {
+// ErrMalformedPacket matches any MalformedPacketError with errors.Is
+var ErrMalformedPacket = errors.New("malformed packet")
+
+// MalformedPacketError is returned when a packet can not be decoded, either because a field
+// runs past the end of the payload or because the packet length is out of bounds
+type MalformedPacketError struct {
+	Type   uint8
+	Reason string
+}
+
+func (e *MalformedPacketError) Error() string {
+	if e.Type == 0 {
+		return fmt.Sprintf("malformed packet: %s", e.Reason)
+	}
+	return fmt.Sprintf("malformed packet type %d: %s", e.Type, e.Reason)
+}
+
+func (e *MalformedPacketError) Is(target error) bool {
+	return target == ErrMalformedPacket
+}
+
+func short(need int, have int) error {
+	return &MalformedPacketError{Reason: fmt.Sprintf("need %d bytes, have %d", need, have)}
+}
+
+func Uint32(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, b, short(4, len(b))
+	}
 	v := binary.BigEndian.Uint32(b)
-	return v, b[4:]
+	return v, b[4:], nil
 }
 
-func Uint64(b []byte) (uint64, []byte) {
+func Uint64(b []byte) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, b, short(8, len(b))
+	}
 	v := binary.BigEndian.Uint64(b)
-	return v, b[8:]
+	return v, b[8:], nil
+}
+
+func String(b []byte) (string, []byte, error) {
+	v, b, err := Bytes(b)
+	return string(v), b, err
 }
 
-func String(b []byte) (string, []byte) {
-	l, b := Uint32(b)
-	return string(b[0:l]), b[l:]
+// Bytes decodes a length prefixed byte string. The returned slice aliases b.
+func Bytes(b []byte) ([]byte, []byte, error) {
+	l, r, err := Uint32(b)
+	if err != nil {
+		return nil, b, err
+	}
+	if uint64(l) > uint64(len(r)) {
+		return nil, b, short(int(l), len(r))
+	}
+	return r[0:l], r[l:], nil
 }
 
 func WriteUint64(w io.Writer, v uint64) error {
@@ -47,3 +92,11 @@ func WriteString(w io.Writer, v string) error {
 	_, err := w.Write([]byte(v))
 	return err
 }
+
+func WriteBytes(w io.Writer, v []byte) error {
+	if err := WriteUint32(w, uint32(len(v))); err != nil {
+		return err
+	}
+	_, err := w.Write(v)
+	return err
+}
@@ -1,5 +1,7 @@
 package usftp
 
+import "io/fs"
+
 // FileMode is a partial implementation of FileMode as the std lib implementation is not
 // compatible for reasons I am yet to fully understand
 type FileMode uint32
@@ -8,14 +10,32 @@ const (
 	ModeType    = 0xF000
 	ModeDir     = 0x4000
 	ModeRegular = 0x8000
+	ModeSymlink = 0xA000
+	ModePerm    = 0x01FF
 )
 
+// NewFileMode converts a fs.FileMode to the unix mode bits used on the wire
+func NewFileMode(m fs.FileMode) FileMode {
+	v := FileMode(m.Perm())
+	switch {
+	case m.IsDir():
+		v |= ModeDir
+	case m&fs.ModeSymlink != 0:
+		v |= ModeSymlink
+	case m.IsRegular():
+		v |= ModeRegular
+	}
+	return v
+}
+
 func (m FileMode) String() string {
 	b := make([]byte, 10)
 	switch m & ModeType {
 	case ModeDir:
 		b[0] = 'd'
-	case ModeRegular:
+	case ModeSymlink:
+		b[0] = 'l'
+	default:
 		b[0] = '-'
 	}
 
@@ -37,3 +57,32 @@ func (m FileMode) IsDir() bool {
 func (m FileMode) IsRegular() bool {
 	return (m & ModeType) == ModeRegular
 }
+
+func (m FileMode) IsSymlink() bool {
+	return (m & ModeType) == ModeSymlink
+}
+
+// FsFileMode converts to a fs.FileMode, keeping the type and permission bits
+func (m FileMode) FsFileMode() fs.FileMode {
+	v := fs.FileMode(m & ModePerm)
+	switch m & ModeType {
+	case ModeDir:
+		v |= fs.ModeDir
+	case ModeSymlink:
+		v |= fs.ModeSymlink
+	}
+	return v
+}
+
+// FileInfoAttrs returns the size, permissions and times of fi as Attrs. The access time is not
+// available from fs.FileInfo and is set to the modification time.
+func FileInfoAttrs(fi fs.FileInfo) Attrs {
+	mtime := uint32(fi.ModTime().Unix())
+	return Attrs{
+		Flags:       SSH_FILEXFER_ATTR_SIZE | SSH_FILEXFER_ATTR_PERMISSIONS | SSH_FILEXFER_ATTR_ACMODTIME,
+		Size:        uint64(fi.Size()),
+		Permissions: NewFileMode(fi.Mode()),
+		Atime:       mtime,
+		Mtime:       mtime,
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/richardjennings/usftp
 
-go 1.24.5
+go 1.25.0
 
 require (
 	golang.org/x/crypto v0.40.0
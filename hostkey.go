@@ -0,0 +1,171 @@
+package usftp
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// tofuMtx serialises appends to trust on first use known_hosts files
+var tofuMtx sync.Mutex
+
+// WithKnownHostsFiles verifies the host key against files in known_hosts format instead of
+// ~/.ssh/known_hosts
+func WithKnownHostsFiles(files ...string) DialOption {
+	return func(o *dialOptions) {
+		o.knownHosts = append(o.knownHosts, files...)
+	}
+}
+
+// withoutKnownHostsFiles consults no known hosts files rather than ~/.ssh/known_hosts, as with
+// UserKnownHostsFile none in ssh_config(5), so only hosts trusted by other options are accepted
+func withoutKnownHostsFiles() DialOption {
+	return func(o *dialOptions) {
+		o.noKnownHosts = true
+	}
+}
+
+// WithFingerprints accepts only host keys with one of the SHA256 fingerprints given, in the
+// "SHA256:..." form printed by ssh-keygen -l. Known hosts files are not consulted.
+func WithFingerprints(fingerprints ...string) DialOption {
+	return func(o *dialOptions) {
+		o.fingerprints = append(o.fingerprints, fingerprints...)
+	}
+}
+
+// WithTrustOnFirstUse accepts the key of a host not yet in the known_hosts file path and
+// appends it there, which is created if missing. A host listed with a different key is refused.
+// Files given with WithKnownHostsFiles are also consulted.
+func WithTrustOnFirstUse(path string) DialOption {
+	return func(o *dialOptions) {
+		o.trustOnFirstUse = path
+	}
+}
+
+// WithInsecureIgnoreHostKey accepts any host key. It should only be used for testing.
+func WithInsecureIgnoreHostKey() DialOption {
+	return func(o *dialOptions) {
+		o.insecure = true
+	}
+}
+
+// hostKeyCallback verifies host keys as configured by the options, by default against
+// ~/.ssh/known_hosts. It also returns the host key algorithms of the keys known for addr, so
+// that the server presents a key which can be verified, or nil to offer the defaults.
+func (o dialOptions) hostKeyCallback(addr string) (ssh.HostKeyCallback, []string, error) {
+	if o.insecure {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+	if len(o.fingerprints) > 0 {
+		return fingerprintCallback(o.fingerprints), nil, nil
+	}
+	files := o.knownHosts
+	if len(files) == 0 && o.trustOnFirstUse == "" && !o.noKnownHosts {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("known_hosts: %w", err)
+		}
+		files = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+	if o.trustOnFirstUse != "" {
+		if err := createKnownHosts(o.trustOnFirstUse); err != nil {
+			return nil, nil, fmt.Errorf("known_hosts: %w", err)
+		}
+		files = append(files, o.trustOnFirstUse)
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("known_hosts: %w", err)
+	}
+	algorithms := knownAlgorithms(callback, addr)
+	if o.trustOnFirstUse == "" {
+		return callback, algorithms, nil
+	}
+	path := o.trustOnFirstUse
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+		// the host is unknown rather than presenting a different key
+		return appendKnownHost(path, hostname, key)
+	}, algorithms, nil
+}
+
+// knownAlgorithms returns the host key algorithms for the keys callback knows for addr, by
+// checking a key which can not match and reading the keys wanted from the error
+func knownAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(addr, &net.TCPAddr{IP: net.IPv4zero}, probe), &keyErr) {
+		return nil
+	}
+	var algorithms []string
+	seen := map[string]bool{}
+	for _, k := range keyErr.Want {
+		for _, a := range keyAlgorithms(k.Key.Type()) {
+			if !seen[a] {
+				seen[a] = true
+				algorithms = append(algorithms, a)
+			}
+		}
+	}
+	return algorithms
+}
+
+// keyAlgorithms returns the signature algorithms a host may use with a key of keyType
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+func fingerprintCallback(fingerprints []string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		fp := ssh.FingerprintSHA256(key)
+		for _, f := range fingerprints {
+			if f == fp {
+				return nil
+			}
+		}
+		return fmt.Errorf("host key %s for %s does not match a pinned fingerprint", fp, hostname)
+	}
+}
+
+func createKnownHosts(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func appendKnownHost(path string, hostname string, key ssh.PublicKey) error {
+	tofuMtx.Lock()
+	defer tofuMtx.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("known_hosts: %w", err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n"
+	if _, err := f.WriteString(line); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("known_hosts: %w", err)
+	}
+	return f.Close()
+}
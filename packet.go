@@ -3,7 +3,6 @@ package usftp
 import (
 	"bytes"
 	"encoding"
-	"encoding/binary"
 	"errors"
 	"fmt"
 )
@@ -111,6 +110,12 @@ type (
 		id() uint32
 	}
 
+	// request is a message sent with a sequence id set by the Session
+	request interface {
+		Msg
+		setId(uint32)
+	}
+
 	// Header embeds a sequence implementation in messages that required one
 	Header struct {
 		Id uint32
@@ -162,18 +167,19 @@ type (
 	// do not recognize.
 	InitReq struct {
 		Version    uint32
-		Extensions []struct {
-			Name string
-			Data string
-		}
+		Extensions []Extension
 	}
 
 	VersionResp struct {
 		Version    uint32
-		Extensions []struct {
-			Name string
-			Data string
-		}
+		Extensions []Extension
+	}
+
+	// Extension is a name, data pair used by SSH_FXP_INIT, SSH_FXP_VERSION and extended
+	// attributes
+	Extension struct {
+		Name string
+		Data string
 	}
 
 	OpenDirReq struct {
@@ -231,51 +237,207 @@ type (
 		Len    uint32
 	}
 
+	// WriteReq
+	// Writing to a file is achieved using the SSH_FXP_WRITE message
+	WriteReq struct {
+		Header
+		Handle string
+		Offset uint64
+		Data   []byte
+	}
+
+	RemoveReq struct {
+		Header
+		Filename string
+	}
+
+	RenameReq struct {
+		Header
+		OldPath string
+		NewPath string
+	}
+
+	MkdirReq struct {
+		Header
+		Path  string
+		Attrs Attrs
+	}
+
+	RmdirReq struct {
+		Header
+		Path string
+	}
+
+	// StatReq follows symbolic links, LstatReq does not
+	StatReq struct {
+		Header
+		Path string
+	}
+
+	LstatReq struct {
+		Header
+		Path string
+	}
+
+	FstatReq struct {
+		Header
+		Handle string
+	}
+
+	SetstatReq struct {
+		Header
+		Path  string
+		Attrs Attrs
+	}
+
+	FsetstatReq struct {
+		Header
+		Handle string
+		Attrs  Attrs
+	}
+
+	ReadlinkReq struct {
+		Header
+		Path string
+	}
+
+	// SymlinkReq
+	// The fields are in the order given by the draft. OpenSSH sends the target
+	// path first, so LinkPath and TargetPath are swapped when talking to it.
+	SymlinkReq struct {
+		Header
+		LinkPath   string
+		TargetPath string
+	}
+
+	RealpathReq struct {
+		Header
+		Path string
+	}
+
 	DataResp struct {
 		Header
 		Data []byte
 	}
 
+	AttrsResp struct {
+		Header
+		Attrs Attrs
+	}
+
+	// ExtendedReq
+	// Data holds the request specific data that follows the request name
+	ExtendedReq struct {
+		Header
+		Request string
+		Data    []byte
+	}
+
+	// ExtendedReplyResp
+	// Data holds the request specific reply data
+	ExtendedReplyResp struct {
+		Header
+		Data []byte
+	}
+
+	// Attrs
+	// Flags determines which of the fields are present on the wire, a field is only sent when
+	// its SSH_FILEXFER_ATTR_* flag is set
 	Attrs struct {
-		Size          uint64
-		Uid           uint32
-		Gid           uint32
-		Permissions   FileMode
-		Atime         uint32
-		Mtime         uint32
+		Flags       uint32
+		Size        uint64
+		Uid         uint32
+		Gid         uint32
+		Permissions FileMode
+		Atime       uint32
+		Mtime       uint32
+		Extended    []Extension
+
+		// Deprecated: use Extended. ExtendedCount is the number of extended attributes
+		// received, ExtendedType and ExtendedData hold the last of them.
 		ExtendedCount uint32
-		ExtendedType  string
-		ExtendedData  string
+		// Deprecated: use Extended
+		ExtendedType string
+		// Deprecated: use Extended
+		ExtendedData string
 	}
 )
 
-func (p *packet) message() (Msg, error) {
-	var m Msg
-	switch p.Type {
+// NewMsg returns an empty message for the packet type t
+func NewMsg(t uint8) (Msg, error) {
+	switch t {
 	case SSH_FXP_INIT:
-		m = &InitReq{}
+		return &InitReq{}, nil
 	case SSH_FXP_VERSION:
-		m = &VersionResp{}
+		return &VersionResp{}, nil
+	case SSH_FXP_OPEN:
+		return &OpenReq{}, nil
+	case SSH_FXP_CLOSE:
+		return &CloseReq{}, nil
+	case SSH_FXP_READ:
+		return &ReadReq{}, nil
+	case SSH_FXP_WRITE:
+		return &WriteReq{}, nil
+	case SSH_FXP_LSTAT:
+		return &LstatReq{}, nil
+	case SSH_FXP_FSTAT:
+		return &FstatReq{}, nil
+	case SSH_FXP_SETSTAT:
+		return &SetstatReq{}, nil
+	case SSH_FXP_FSETSTAT:
+		return &FsetstatReq{}, nil
 	case SSH_FXP_OPENDIR:
-		m = &OpenDirReq{}
+		return &OpenDirReq{}, nil
+	case SSH_FXP_READDIR:
+		return &ReadDirReq{}, nil
+	case SSH_FXP_REMOVE:
+		return &RemoveReq{}, nil
+	case SSH_FXP_MKDIR:
+		return &MkdirReq{}, nil
+	case SSH_FXP_RMDIR:
+		return &RmdirReq{}, nil
+	case SSH_FXP_REALPATH:
+		return &RealpathReq{}, nil
+	case SSH_FXP_STAT:
+		return &StatReq{}, nil
+	case SSH_FXP_RENAME:
+		return &RenameReq{}, nil
+	case SSH_FXP_READLINK:
+		return &ReadlinkReq{}, nil
+	case SSH_FXP_SYMLINK:
+		return &SymlinkReq{}, nil
 	case SSH_FXP_STATUS:
-		m = &StatusResp{}
+		return &StatusResp{}, nil
 	case SSH_FXP_HANDLE:
-		m = &HandleResp{}
-	case SSH_FXP_READDIR:
-		m = &ReadDirReq{}
-	case SSH_FXP_NAME:
-		m = &NameResp{}
-	case SSH_FXP_OPEN:
-		m = &OpenReq{}
-	case SSH_FXP_READ:
-		m = &ReadReq{}
+		return &HandleResp{}, nil
 	case SSH_FXP_DATA:
-		m = &DataResp{}
+		return &DataResp{}, nil
+	case SSH_FXP_NAME:
+		return &NameResp{}, nil
+	case SSH_FXP_ATTRS:
+		return &AttrsResp{}, nil
+	case SSH_FXP_EXTENDED:
+		return &ExtendedReq{}, nil
+	case SSH_FXP_EXTENDED_REPLY:
+		return &ExtendedReplyResp{}, nil
 	default:
-		return nil, fmt.Errorf("unknown packet type: %v", p.Type)
+		return nil, fmt.Errorf("%w: unknown packet type %v", errors.ErrUnsupported, t)
+	}
+}
+
+func (p *packet) message() (Msg, error) {
+	m, err := NewMsg(p.Type)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.UnmarshalBinary(p.Payload); err != nil {
+		var mErr *MalformedPacketError
+		if errors.As(err, &mErr) {
+			mErr.Type = p.Type
+		}
+		return nil, err
 	}
-	return m, m.UnmarshalBinary(p.Payload)
+	return m, nil
 }
 
 func TypeId(m Msg) (uint8, error) {
@@ -284,16 +446,56 @@ func TypeId(m Msg) (uint8, error) {
 		return SSH_FXP_INIT, nil
 	case *VersionResp:
 		return SSH_FXP_VERSION, nil
-	case *OpenDirReq:
-		return SSH_FXP_OPENDIR, nil
-	case *ReadDirReq:
-		return SSH_FXP_READDIR, nil
-	case *CloseReq:
-		return SSH_FXP_CLOSE, nil
 	case *OpenReq:
 		return SSH_FXP_OPEN, nil
+	case *CloseReq:
+		return SSH_FXP_CLOSE, nil
 	case *ReadReq:
 		return SSH_FXP_READ, nil
+	case *WriteReq:
+		return SSH_FXP_WRITE, nil
+	case *LstatReq:
+		return SSH_FXP_LSTAT, nil
+	case *FstatReq:
+		return SSH_FXP_FSTAT, nil
+	case *SetstatReq:
+		return SSH_FXP_SETSTAT, nil
+	case *FsetstatReq:
+		return SSH_FXP_FSETSTAT, nil
+	case *OpenDirReq:
+		return SSH_FXP_OPENDIR, nil
+	case *ReadDirReq:
+		return SSH_FXP_READDIR, nil
+	case *RemoveReq:
+		return SSH_FXP_REMOVE, nil
+	case *MkdirReq:
+		return SSH_FXP_MKDIR, nil
+	case *RmdirReq:
+		return SSH_FXP_RMDIR, nil
+	case *RealpathReq:
+		return SSH_FXP_REALPATH, nil
+	case *StatReq:
+		return SSH_FXP_STAT, nil
+	case *RenameReq:
+		return SSH_FXP_RENAME, nil
+	case *ReadlinkReq:
+		return SSH_FXP_READLINK, nil
+	case *SymlinkReq:
+		return SSH_FXP_SYMLINK, nil
+	case *StatusResp:
+		return SSH_FXP_STATUS, nil
+	case *HandleResp:
+		return SSH_FXP_HANDLE, nil
+	case *DataResp:
+		return SSH_FXP_DATA, nil
+	case *NameResp:
+		return SSH_FXP_NAME, nil
+	case *AttrsResp:
+		return SSH_FXP_ATTRS, nil
+	case *ExtendedReq:
+		return SSH_FXP_EXTENDED, nil
+	case *ExtendedReplyResp:
+		return SSH_FXP_EXTENDED_REPLY, nil
 	default:
 		return 0, fmt.Errorf("unhandled msg type: %T", m)
 	}
@@ -303,138 +505,326 @@ func (h Header) id() uint32 {
 	return h.Id
 }
 
-func (i *InitReq) UnmarshalBinary(b []byte) error {
-	i.Version, _ = Uint32(b)
+func (h *Header) setId(id uint32) {
+	h.Id = id
+}
+
+func marshalExtensions(buf *bytes.Buffer, extensions []Extension) error {
+	for _, e := range extensions {
+		if err := WriteString(buf, e.Name); err != nil {
+			return err
+		}
+		if err := WriteString(buf, e.Data); err != nil {
+			return err
+		}
+	}
 	return nil
 }
-func (i *InitReq) MarshalBinary() ([]byte, error) {
-	buf := bytes.NewBuffer(nil)
-	if err := binary.Write(buf, binary.BigEndian, i.Version); err != nil {
-		return nil, err
+
+func unmarshalExtensions(b []byte) ([]Extension, error) {
+	var extensions []Extension
+	var err error
+	for len(b) > 0 {
+		e := Extension{}
+		if e.Name, b, err = String(b); err != nil {
+			return nil, err
+		}
+		if e.Data, b, err = String(b); err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, e)
 	}
-	return buf.Bytes(), nil
+	return extensions, nil
 }
 
-func (v *VersionResp) UnmarshalBinary(b []byte) error {
-	v.Version, _ = Uint32(b)
+func (a *Attrs) marshal(buf *bytes.Buffer) error {
+	if err := WriteUint32(buf, a.Flags); err != nil {
+		return err
+	}
+	if a.Flags&SSH_FILEXFER_ATTR_SIZE != 0 {
+		if err := WriteUint64(buf, a.Size); err != nil {
+			return err
+		}
+	}
+	if a.Flags&SSH_FILEXFER_ATTR_UIDGID != 0 {
+		if err := WriteUint32(buf, a.Uid); err != nil {
+			return err
+		}
+		if err := WriteUint32(buf, a.Gid); err != nil {
+			return err
+		}
+	}
+	if a.Flags&SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		if err := WriteUint32(buf, uint32(a.Permissions)); err != nil {
+			return err
+		}
+	}
+	if a.Flags&SSH_FILEXFER_ATTR_ACMODTIME != 0 {
+		if err := WriteUint32(buf, a.Atime); err != nil {
+			return err
+		}
+		if err := WriteUint32(buf, a.Mtime); err != nil {
+			return err
+		}
+	}
+	if a.Flags&SSH_FILEXFER_ATTR_EXTENDED != 0 {
+		extended := a.Extended
+		if len(extended) == 0 && a.ExtendedType != "" {
+			extended = []Extension{{Name: a.ExtendedType, Data: a.ExtendedData}}
+		}
+		if err := WriteUint32(buf, uint32(len(extended))); err != nil {
+			return err
+		}
+		if err := marshalExtensions(buf, extended); err != nil {
+			return err
+		}
+	}
 	return nil
 }
-func (v *VersionResp) MarshalBinary() ([]byte, error) {
-	return nil, nil
+
+func (a *Attrs) unmarshal(b []byte) ([]byte, error) {
+	var err error
+	if a.Flags, b, err = Uint32(b); err != nil {
+		return b, err
+	}
+	if a.Flags&SSH_FILEXFER_ATTR_SIZE != 0 {
+		if a.Size, b, err = Uint64(b); err != nil {
+			return b, err
+		}
+	}
+	if a.Flags&SSH_FILEXFER_ATTR_UIDGID != 0 {
+		if a.Uid, b, err = Uint32(b); err != nil {
+			return b, err
+		}
+		if a.Gid, b, err = Uint32(b); err != nil {
+			return b, err
+		}
+	}
+	if a.Flags&SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		var p uint32
+		if p, b, err = Uint32(b); err != nil {
+			return b, err
+		}
+		a.Permissions = FileMode(p)
+	}
+	if a.Flags&SSH_FILEXFER_ATTR_ACMODTIME != 0 {
+		if a.Atime, b, err = Uint32(b); err != nil {
+			return b, err
+		}
+		if a.Mtime, b, err = Uint32(b); err != nil {
+			return b, err
+		}
+	}
+	if a.Flags&SSH_FILEXFER_ATTR_EXTENDED != 0 {
+		var count uint32
+		if count, b, err = Uint32(b); err != nil {
+			return b, err
+		}
+		for i := uint32(0); i < count; i++ {
+			e := Extension{}
+			if e.Name, b, err = String(b); err != nil {
+				return b, err
+			}
+			if e.Data, b, err = String(b); err != nil {
+				return b, err
+			}
+			a.Extended = append(a.Extended, e)
+			a.ExtendedType, a.ExtendedData = e.Name, e.Data
+		}
+		a.ExtendedCount = count
+	}
+	return b, nil
 }
 
-func (r *OpenDirReq) UnmarshalBinary(b []byte) error {
-	return nil
+// unmarshalIdString decodes the id and single string common to many requests
+func unmarshalIdString(b []byte, id *uint32, s *string) ([]byte, error) {
+	var err error
+	if *id, b, err = Uint32(b); err != nil {
+		return b, err
+	}
+	*s, b, err = String(b)
+	return b, err
 }
-func (r *OpenDirReq) MarshalBinary() ([]byte, error) {
+
+// marshalIdString encodes the id and single string common to many requests
+func marshalIdString(id uint32, s string) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
-	if err := binary.Write(buf, binary.BigEndian, r.Id); err != nil {
+	if err := WriteUint32(buf, id); err != nil {
 		return nil, err
 	}
-	if err := binary.Write(buf, binary.BigEndian, uint32(len([]rune(r.Path)))); err != nil {
+	if err := WriteString(buf, s); err != nil {
 		return nil, err
 	}
-	buf.WriteString(r.Path)
 	return buf.Bytes(), nil
 }
 
-func (r *ReadDirReq) UnmarshalBinary(b []byte) error {
-	return nil
+func (i *InitReq) UnmarshalBinary(b []byte) error {
+	var err error
+	if i.Version, b, err = Uint32(b); err != nil {
+		return err
+	}
+	i.Extensions, err = unmarshalExtensions(b)
+	return err
 }
-func (r *ReadDirReq) MarshalBinary() ([]byte, error) {
+func (i *InitReq) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := WriteUint32(buf, i.Version); err != nil {
+		return nil, err
+	}
+	if err := marshalExtensions(buf, i.Extensions); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (v *VersionResp) UnmarshalBinary(b []byte) error {
+	var err error
+	if v.Version, b, err = Uint32(b); err != nil {
+		return err
+	}
+	v.Extensions, err = unmarshalExtensions(b)
+	return err
+}
+func (v *VersionResp) MarshalBinary() ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
-	if err := binary.Write(buf, binary.BigEndian, r.Id); err != nil {
+	if err := WriteUint32(buf, v.Version); err != nil {
 		return nil, err
 	}
-	if err := binary.Write(buf, binary.BigEndian, uint32(len(r.Handle))); err != nil {
+	if err := marshalExtensions(buf, v.Extensions); err != nil {
 		return nil, err
 	}
-	buf.Write([]byte(r.Handle))
 	return buf.Bytes(), nil
 }
 
+func (r *OpenDirReq) UnmarshalBinary(b []byte) error {
+	_, err := unmarshalIdString(b, &r.Id, &r.Path)
+	return err
+}
+func (r *OpenDirReq) MarshalBinary() ([]byte, error) {
+	return marshalIdString(r.Id, r.Path)
+}
+
+func (r *ReadDirReq) UnmarshalBinary(b []byte) error {
+	_, err := unmarshalIdString(b, &r.Id, &r.Handle)
+	return err
+}
+func (r *ReadDirReq) MarshalBinary() ([]byte, error) {
+	return marshalIdString(r.Id, r.Handle)
+}
+
 func (r *HandleResp) UnmarshalBinary(b []byte) error {
-	r.Id, b = Uint32(b)
-	r.Handle, _ = String(b)
-	return nil
+	_, err := unmarshalIdString(b, &r.Id, &r.Handle)
+	return err
 }
 func (r *HandleResp) MarshalBinary() ([]byte, error) {
-	return nil, nil
+	return marshalIdString(r.Id, r.Handle)
 }
 
 func (r *CloseReq) UnmarshalBinary(b []byte) error {
-	return nil
+	_, err := unmarshalIdString(b, &r.Id, &r.Handle)
+	return err
 }
 func (r *CloseReq) MarshalBinary() ([]byte, error) {
+	return marshalIdString(r.Id, r.Handle)
+}
+
+func (r *StatusResp) UnmarshalBinary(b []byte) error {
+	var err error
+	if r.Id, b, err = Uint32(b); err != nil {
+		return err
+	}
+	if r.ErrorCode, b, err = Uint32(b); err != nil {
+		return err
+	}
+	// some servers omit the message and language tag
+	if len(b) == 0 {
+		return nil
+	}
+	if r.ErrorMessage, b, err = String(b); err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	r.LanguageTag, _, err = String(b)
+	return err
+}
+func (r *StatusResp) MarshalBinary() ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 	if err := WriteUint32(buf, r.Id); err != nil {
 		return nil, err
 	}
-	if err := WriteString(buf, r.Handle); err != nil {
+	if err := WriteUint32(buf, r.ErrorCode); err != nil {
+		return nil, err
+	}
+	if err := WriteString(buf, r.ErrorMessage); err != nil {
+		return nil, err
+	}
+	if err := WriteString(buf, r.LanguageTag); err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-func (r *StatusResp) UnmarshalBinary(b []byte) error {
-	r.Id, b = Uint32(b)
-	r.ErrorCode, b = Uint32(b)
-	r.ErrorMessage, _ = String(b)
-	return nil
-}
-func (r *StatusResp) MarshalBinary() ([]byte, error) {
-	return nil, nil
-}
-
 func (r *NameResp) UnmarshalBinary(b []byte) error {
-	r.Id, b = Uint32(b)
-	r.Count, b = Uint32(b)
-	var flags uint32
-
+	var err error
+	if r.Id, b, err = Uint32(b); err != nil {
+		return err
+	}
+	if r.Count, b, err = Uint32(b); err != nil {
+		return err
+	}
 	for i := uint32(0); i < r.Count; i++ {
 		v := NameRespFile{}
-		v.Filename, b = String(b)
-		v.Longname, b = String(b)
-		flags, b = Uint32(b)
-		if flags&SSH_FILEXFER_ATTR_SIZE != 0 {
-			v.Attrs.Size, b = Uint64(b)
+		if v.Filename, b, err = String(b); err != nil {
+			return err
 		}
-		if flags&SSH_FILEXFER_ATTR_UIDGID != 0 {
-			v.Attrs.Uid, b = Uint32(b)
-			v.Attrs.Gid, b = Uint32(b)
+		if v.Longname, b, err = String(b); err != nil {
+			return err
 		}
-		if flags&SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
-			var p uint32
-			p, b = Uint32(b)
-			v.Attrs.Permissions = FileMode(p)
+		if b, err = v.Attrs.unmarshal(b); err != nil {
+			return err
 		}
-		if flags&SSH_FILEXFER_ATTR_ACMODTIME != 0 {
-			v.Attrs.Atime, b = Uint32(b)
-			v.Attrs.Mtime, b = Uint32(b)
-		}
-		if flags&SSH_FILEXFER_ATTR_EXTENDED != 0 {
-			v.Attrs.ExtendedCount, b = Uint32(b)
-			if v.Attrs.ExtendedCount > 0 {
-				panic("extended count not supported yet")
-			}
-		}
-
 		r.Names = append(r.Names, &v)
 	}
 	return nil
 }
 
+// MarshalBinary writes len(Names) as the count
 func (r *NameResp) MarshalBinary() ([]byte, error) {
-	return nil, nil
+	buf := bytes.NewBuffer(nil)
+	if err := WriteUint32(buf, r.Id); err != nil {
+		return nil, err
+	}
+	if err := WriteUint32(buf, uint32(len(r.Names))); err != nil {
+		return nil, err
+	}
+	for _, v := range r.Names {
+		if err := WriteString(buf, v.Filename); err != nil {
+			return nil, err
+		}
+		if err := WriteString(buf, v.Longname); err != nil {
+			return nil, err
+		}
+		if err := v.Attrs.marshal(buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
 }
 
 func (r *OpenReq) UnmarshalBinary(b []byte) error {
-	return nil
+	var err error
+	if b, err = unmarshalIdString(b, &r.Id, &r.Filename); err != nil {
+		return err
+	}
+	if r.Pflags, b, err = Uint32(b); err != nil {
+		return err
+	}
+	_, err = r.Attrs.unmarshal(b)
+	return err
 }
 func (r *OpenReq) MarshalBinary() ([]byte, error) {
-	if r.Pflags&SSH_FXF_READ == 0 {
-		return nil, errors.New("SSH_FXF_READ needs to be set for reading")
-	}
 	buf := bytes.NewBuffer(nil)
 	if err := WriteUint32(buf, r.Id); err != nil {
 		return nil, err
@@ -445,17 +835,22 @@ func (r *OpenReq) MarshalBinary() ([]byte, error) {
 	if err := WriteUint32(buf, r.Pflags); err != nil {
 		return nil, err
 	}
-
-	// currently write 0 flag mask and 0 attributes
-	if err := WriteUint32(buf, 0); err != nil {
+	if err := r.Attrs.marshal(buf); err != nil {
 		return nil, err
 	}
-
 	return buf.Bytes(), nil
 }
 
 func (r *ReadReq) UnmarshalBinary(b []byte) error {
-	return nil
+	var err error
+	if b, err = unmarshalIdString(b, &r.Id, &r.Handle); err != nil {
+		return err
+	}
+	if r.Offset, b, err = Uint64(b); err != nil {
+		return err
+	}
+	r.Len, _, err = Uint32(b)
+	return err
 }
 func (r *ReadReq) MarshalBinary() ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
@@ -474,12 +869,261 @@ func (r *ReadReq) MarshalBinary() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+func (r *WriteReq) UnmarshalBinary(b []byte) error {
+	var err error
+	if b, err = unmarshalIdString(b, &r.Id, &r.Handle); err != nil {
+		return err
+	}
+	if r.Offset, b, err = Uint64(b); err != nil {
+		return err
+	}
+	r.Data, _, err = Bytes(b)
+	return err
+}
+func (r *WriteReq) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := WriteUint32(buf, r.Id); err != nil {
+		return nil, err
+	}
+	if err := WriteString(buf, r.Handle); err != nil {
+		return nil, err
+	}
+	if err := WriteUint64(buf, r.Offset); err != nil {
+		return nil, err
+	}
+	if err := WriteBytes(buf, r.Data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *RemoveReq) UnmarshalBinary(b []byte) error {
+	_, err := unmarshalIdString(b, &r.Id, &r.Filename)
+	return err
+}
+func (r *RemoveReq) MarshalBinary() ([]byte, error) {
+	return marshalIdString(r.Id, r.Filename)
+}
+
+func (r *RenameReq) UnmarshalBinary(b []byte) error {
+	var err error
+	if b, err = unmarshalIdString(b, &r.Id, &r.OldPath); err != nil {
+		return err
+	}
+	r.NewPath, _, err = String(b)
+	return err
+}
+func (r *RenameReq) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := WriteUint32(buf, r.Id); err != nil {
+		return nil, err
+	}
+	if err := WriteString(buf, r.OldPath); err != nil {
+		return nil, err
+	}
+	if err := WriteString(buf, r.NewPath); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *MkdirReq) UnmarshalBinary(b []byte) error {
+	var err error
+	if b, err = unmarshalIdString(b, &r.Id, &r.Path); err != nil {
+		return err
+	}
+	_, err = r.Attrs.unmarshal(b)
+	return err
+}
+func (r *MkdirReq) MarshalBinary() ([]byte, error) {
+	b, err := marshalIdString(r.Id, r.Path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(b)
+	if err := r.Attrs.marshal(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *RmdirReq) UnmarshalBinary(b []byte) error {
+	_, err := unmarshalIdString(b, &r.Id, &r.Path)
+	return err
+}
+func (r *RmdirReq) MarshalBinary() ([]byte, error) {
+	return marshalIdString(r.Id, r.Path)
+}
+
+func (r *StatReq) UnmarshalBinary(b []byte) error {
+	_, err := unmarshalIdString(b, &r.Id, &r.Path)
+	return err
+}
+func (r *StatReq) MarshalBinary() ([]byte, error) {
+	return marshalIdString(r.Id, r.Path)
+}
+
+func (r *LstatReq) UnmarshalBinary(b []byte) error {
+	_, err := unmarshalIdString(b, &r.Id, &r.Path)
+	return err
+}
+func (r *LstatReq) MarshalBinary() ([]byte, error) {
+	return marshalIdString(r.Id, r.Path)
+}
+
+func (r *FstatReq) UnmarshalBinary(b []byte) error {
+	_, err := unmarshalIdString(b, &r.Id, &r.Handle)
+	return err
+}
+func (r *FstatReq) MarshalBinary() ([]byte, error) {
+	return marshalIdString(r.Id, r.Handle)
+}
+
+func (r *SetstatReq) UnmarshalBinary(b []byte) error {
+	var err error
+	if b, err = unmarshalIdString(b, &r.Id, &r.Path); err != nil {
+		return err
+	}
+	_, err = r.Attrs.unmarshal(b)
+	return err
+}
+func (r *SetstatReq) MarshalBinary() ([]byte, error) {
+	b, err := marshalIdString(r.Id, r.Path)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(b)
+	if err := r.Attrs.marshal(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *FsetstatReq) UnmarshalBinary(b []byte) error {
+	var err error
+	if b, err = unmarshalIdString(b, &r.Id, &r.Handle); err != nil {
+		return err
+	}
+	_, err = r.Attrs.unmarshal(b)
+	return err
+}
+func (r *FsetstatReq) MarshalBinary() ([]byte, error) {
+	b, err := marshalIdString(r.Id, r.Handle)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(b)
+	if err := r.Attrs.marshal(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *ReadlinkReq) UnmarshalBinary(b []byte) error {
+	_, err := unmarshalIdString(b, &r.Id, &r.Path)
+	return err
+}
+func (r *ReadlinkReq) MarshalBinary() ([]byte, error) {
+	return marshalIdString(r.Id, r.Path)
+}
+
+func (r *SymlinkReq) UnmarshalBinary(b []byte) error {
+	var err error
+	if b, err = unmarshalIdString(b, &r.Id, &r.LinkPath); err != nil {
+		return err
+	}
+	r.TargetPath, _, err = String(b)
+	return err
+}
+func (r *SymlinkReq) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := WriteUint32(buf, r.Id); err != nil {
+		return nil, err
+	}
+	if err := WriteString(buf, r.LinkPath); err != nil {
+		return nil, err
+	}
+	if err := WriteString(buf, r.TargetPath); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *RealpathReq) UnmarshalBinary(b []byte) error {
+	_, err := unmarshalIdString(b, &r.Id, &r.Path)
+	return err
+}
+func (r *RealpathReq) MarshalBinary() ([]byte, error) {
+	return marshalIdString(r.Id, r.Path)
+}
+
 func (r *DataResp) UnmarshalBinary(b []byte) error {
-	r.Id, b = Uint32(b)
-	_, b = Uint32(b)
+	var err error
+	if r.Id, b, err = Uint32(b); err != nil {
+		return err
+	}
+	r.Data, _, err = Bytes(b)
+	return err
+}
+func (r *DataResp) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := WriteUint32(buf, r.Id); err != nil {
+		return nil, err
+	}
+	if err := WriteBytes(buf, r.Data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *AttrsResp) UnmarshalBinary(b []byte) error {
+	var err error
+	if r.Id, b, err = Uint32(b); err != nil {
+		return err
+	}
+	_, err = r.Attrs.unmarshal(b)
+	return err
+}
+func (r *AttrsResp) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := WriteUint32(buf, r.Id); err != nil {
+		return nil, err
+	}
+	if err := r.Attrs.marshal(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *ExtendedReq) UnmarshalBinary(b []byte) error {
+	var err error
+	if b, err = unmarshalIdString(b, &r.Id, &r.Request); err != nil {
+		return err
+	}
 	r.Data = b
 	return nil
 }
-func (r *DataResp) MarshalBinary() ([]byte, error) {
-	return nil, nil
+func (r *ExtendedReq) MarshalBinary() ([]byte, error) {
+	b, err := marshalIdString(r.Id, r.Request)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, r.Data...), nil
+}
+
+func (r *ExtendedReplyResp) UnmarshalBinary(b []byte) error {
+	var err error
+	if r.Id, b, err = Uint32(b); err != nil {
+		return err
+	}
+	r.Data = b
+	return nil
+}
+func (r *ExtendedReplyResp) MarshalBinary() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := WriteUint32(buf, r.Id); err != nil {
+		return nil, err
+	}
+	buf.Write(r.Data)
+	return buf.Bytes(), nil
 }
@@ -0,0 +1,126 @@
+package usftp
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+type (
+	// Progress reports the state of a transfer to the callback given to WithProgress
+	Progress struct {
+		// Path is the remote file being transferred
+		Path string
+		// Bytes is the number of bytes of the file transferred, including any transferred
+		// before a transfer was resumed
+		Bytes uint64
+		// Total is the size of the file, or 0 when unknown
+		Total uint64
+		// Rate is the average number of bytes transferred per second
+		Rate float64
+		// ETA is the estimated time remaining, or 0 when unknown
+		ETA time.Duration
+	}
+
+	// TransferStats are added to by each transfer given WithStats when it completes or fails
+	TransferStats struct {
+		Bytes    uint64
+		Duration time.Duration
+		Requests int
+	}
+
+	// transfer tracks the progress of a single file
+	transfer struct {
+		transferOptions
+		path     string
+		start    time.Time
+		offset   uint64
+		total    uint64
+		bytes    uint64
+		requests int
+	}
+)
+
+// WithProgress calls progress as a transfer proceeds, after each read or write request
+func WithProgress(progress func(Progress)) TransferOption {
+	return func(o *transferOptions) {
+		o.progress = progress
+	}
+}
+
+// WithStats adds the bytes transferred, time taken and requests sent by a transfer to stats
+func WithStats(stats *TransferStats) TransferOption {
+	return func(o *transferOptions) {
+		o.stats = stats
+	}
+}
+
+func newTransfer(path string, o transferOptions) *transfer {
+	return &transfer{transferOptions: o, path: path, start: time.Now()}
+}
+
+// request counts a request sent for the transfer
+func (t *transfer) request() {
+	t.requests++
+}
+
+// add records n bytes transferred and reports progress
+func (t *transfer) add(n int) {
+	t.bytes += uint64(n)
+	if t.progress == nil {
+		return
+	}
+	p := Progress{Path: t.path, Bytes: t.offset + t.bytes, Total: t.total}
+	if elapsed := time.Since(t.start).Seconds(); elapsed > 0 {
+		p.Rate = float64(t.bytes) / elapsed
+	}
+	if p.Total > p.Bytes && p.Rate > 0 {
+		p.ETA = time.Duration(float64(p.Total-p.Bytes) / p.Rate * float64(time.Second))
+	}
+	t.lock()
+	defer t.unlock()
+	t.progress(p)
+}
+
+// finish adds the transfer to the stats
+func (t *transfer) finish() {
+	if t.stats == nil {
+		return
+	}
+	t.lock()
+	defer t.unlock()
+	t.stats.Bytes += t.bytes
+	t.stats.Duration += time.Since(t.start)
+	t.stats.Requests += t.requests
+}
+
+func (t *transfer) lock() {
+	if t.shared != nil {
+		t.shared.Lock()
+	}
+}
+
+func (t *transfer) unlock() {
+	if t.shared != nil {
+		t.shared.Unlock()
+	}
+}
+
+// readerSize returns the number of bytes remaining in r when it can be determined, or 0
+func readerSize(r io.Reader) uint64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return uint64(r.Len())
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil || offset > fi.Size() {
+			return 0
+		}
+		return uint64(fi.Size() - offset)
+	}
+	return 0
+}
@@ -0,0 +1,109 @@
+package usftp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the bytes per second requested by reads and written by
+// writes. It may be shared by Sessions and transfers to limit them together, and its limit
+// changed while they run. A nil RateLimiter does not limit.
+type RateLimiter struct {
+	mtx    sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing bytesPerSecond, or no limit when it is not
+// positive
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	l := &RateLimiter{last: time.Now()}
+	l.SetLimit(bytesPerSecond)
+	return l
+}
+
+// SetLimit changes the limit to bytesPerSecond, or removes it when bytesPerSecond is not positive
+func (l *RateLimiter) SetLimit(bytesPerSecond int64) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.rate = max(float64(bytesPerSecond), 0)
+	// the bucket holds one second of allowance
+	l.tokens = min(l.tokens, l.rate)
+}
+
+// Limit returns the limit in bytes per second, or 0 when there is none
+func (l *RateLimiter) Limit() int64 {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return int64(l.rate)
+}
+
+// maxLimitWait is the longest a request waits before checking whether the limit has changed
+const maxLimitWait = 50 * time.Millisecond
+
+// take takes n tokens when they are available, returning 0, or otherwise how long to wait before
+// trying again. Requests larger than the bucket take it when full, leaving it in debt.
+func (l *RateLimiter) take(n int) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+	if l.rate <= 0 {
+		l.last = now
+		return 0
+	}
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	need := min(float64(n), l.rate)
+	if l.tokens >= need {
+		l.tokens -= float64(n)
+		return 0
+	}
+	d := time.Duration((need - l.tokens) / l.rate * float64(time.Second))
+	return max(time.Millisecond, min(maxLimitWait, d))
+}
+
+// wait blocks until n bytes are allowed or ctx is done
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for {
+		d := l.take(n)
+		if d <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ErrSessionClosed
+		}
+	}
+}
+
+// WithSessionRateLimit limits the bytes per second transferred by all reads and writes of the
+// Session with l
+func WithSessionRateLimit(l *RateLimiter) SessionOption {
+	return func(o *sessionOptions) {
+		o.limiter = l
+	}
+}
+
+// WithRateLimit limits the bytes per second transferred with l, in addition to any limit of the
+// Session
+func WithRateLimit(l *RateLimiter) TransferOption {
+	return func(o *transferOptions) {
+		o.limiter = l
+	}
+}
+
+// limit waits for both the Session and the transfer limits to allow n bytes
+func (s *Session) limit(t *transfer, n int) error {
+	if err := s.limiter.wait(s.ctx, n); err != nil {
+		return err
+	}
+	return t.limiter.wait(s.ctx, n)
+}
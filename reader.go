@@ -3,15 +3,32 @@ package usftp
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"sync"
 )
 
+// DefaultMaxPacketSize matches the limit OpenSSH applies to the packets it is willing to
+// send and accept
+//
+// https://github.com/openssh/openssh-portable/blob/master/sftp-common.h#L29
+const DefaultMaxPacketSize = 256 * 1024
+
+var ErrSessionClosed = errors.New("session closed")
+
+// ErrConnectionLost is returned by requests on a Session whose transport failed. The Session can
+// not be used again, see Client for re-establishing it.
+var ErrConnectionLost = errors.New("connection lost")
+
 type (
 	reader struct {
-		r        io.Reader
-		rChanMtx sync.Mutex
-		rChan    map[uint32]chan Msg
+		r             io.Reader
+		maxPacketSize uint32
+		rChanMtx      sync.Mutex
+		rChan         map[uint32]chan Msg
+		done          chan struct{}
+		err           error
 	}
 )
 
@@ -20,43 +37,84 @@ func (r *reader) handler(s *Session, ctx context.Context) func() error {
 		for {
 			select {
 			case <-ctx.Done():
+				r.fail(ErrSessionClosed)
 				return nil
 			default:
 				msg, err := s.r.read()
-				if err == io.EOF {
-					continue
-				}
-				s.r.rChanMtx.Lock()
-				if _, ok := msg.(sequence); ok {
-					id := msg.(sequence).id()
-					if _, ok := s.r.rChan[id]; !ok {
-						s.r.rChan[id] = make(chan Msg)
+				if err != nil {
+					if ctx.Err() != nil {
+						r.fail(ErrSessionClosed)
+						return nil
 					}
-					s.r.rChan[id] <- msg
-				} else {
-					s.r.rChan[0] <- msg
+					if err == io.EOF {
+						err = io.ErrUnexpectedEOF
+					}
+					err = fmt.Errorf("%w: %w", ErrConnectionLost, err)
+					r.fail(err)
+					// release writers blocked on the transport, the Session can not be used again
+					_ = s.shutdown()
+					return err
+				}
+				var id uint32
+				if msg, ok := msg.(sequence); ok {
+					id = msg.id()
 				}
-				s.r.rChanMtx.Unlock()
+				r.deliver(id, msg)
 			}
 		}
 	}
 }
 
+// fail records the error that stopped the reader and releases any callers waiting on a response
+func (r *reader) fail(err error) {
+	r.err = err
+	close(r.done)
+}
+
 func (r *reader) read() (Msg, error) {
+	return ReadMsg(r.r, r.maxPacketSize)
+}
+
+// ReadMsg reads a single packet from r and decodes it. The packet length is checked against
+// maxPacketSize before the payload is allocated.
+func ReadMsg(r io.Reader, maxPacketSize uint32) (Msg, error) {
+	t, payload, err := ReadPacket(r, maxPacketSize)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMsg(t, payload)
+}
+
+// ReadPacket reads the type and payload of a single packet from r without decoding it, so that
+// a packet which can not be decoded still leaves r at the start of the next one. The packet
+// length is checked against maxPacketSize before the payload is allocated.
+func ReadPacket(r io.Reader, maxPacketSize uint32) (uint8, []byte, error) {
 	p := &packet{}
 	read := func(v interface{}) error {
-		return binary.Read(r.r, binary.BigEndian, v)
+		return binary.Read(r, binary.BigEndian, v)
 	}
 	if err := read(&p.Length); err != nil {
-		return nil, err
+		return 0, nil, err
+	}
+	// the length includes the type byte
+	if p.Length == 0 || p.Length > maxPacketSize {
+		return 0, nil, &MalformedPacketError{
+			Reason: fmt.Sprintf("packet length %d outside of range 1 - %d", p.Length, maxPacketSize),
+		}
 	}
 	if err := read(&p.Type); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 	p.Payload = make([]byte, p.Length-1)
 	if err := read(&p.Payload); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
+	return p.Type, p.Payload, nil
+}
+
+// DecodeMsg decodes the payload of a packet of type t, as read by ReadPacket
+func DecodeMsg(t uint8, payload []byte) (Msg, error) {
+	p := &packet{Length: uint32(len(payload) + 1), Type: t, Payload: payload}
 	return p.message()
 }
 
@@ -64,11 +122,22 @@ func (r *reader) getChan(s uint32) chan Msg {
 	r.rChanMtx.Lock()
 	defer r.rChanMtx.Unlock()
 	if _, ok := r.rChan[s]; !ok {
-		r.rChan[s] = make(chan Msg)
+		r.rChan[s] = make(chan Msg, 1)
 	}
 	return r.rChan[s]
 }
 
+// deliver passes msg to the caller waiting on id. Responses nobody is waiting for, or which
+// would not fit, are dropped so that a misbehaving server can not block the reader.
+func (r *reader) deliver(id uint32, msg Msg) {
+	r.rChanMtx.Lock()
+	defer r.rChanMtx.Unlock()
+	select {
+	case r.rChan[id] <- msg:
+	default:
+	}
+}
+
 func (r *reader) delChan(s uint32) {
 	r.rChanMtx.Lock()
 	defer r.rChanMtx.Unlock()
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/richardjennings/usftp"
+)
+
+type (
+	// LocalHandler serves a directory of the local filesystem. Clients see root as "/" and can
+	// not reach anything outside of it, either with ".." or by following symbolic links. Every
+	// operation goes through an os.Root, so a directory swapped for a symbolic link while a
+	// request is handled can not be used to escape.
+	LocalHandler struct {
+		root *os.Root
+		// dir is the absolute path of root with symbolic links resolved
+		dir   string
+		chown bool
+	}
+
+	// LocalOption configures a LocalHandler
+	LocalOption func(*LocalHandler)
+
+	localDir struct {
+		*os.File
+		h    *LocalHandler
+		name string
+	}
+
+	localFile struct {
+		*os.File
+		h      *LocalHandler
+		name   string
+		append bool
+	}
+)
+
+// WithChown allows clients to change the owner and group of files. Without it a request to do
+// so fails with fs.ErrPermission.
+func WithChown() LocalOption {
+	return func(h *LocalHandler) {
+		h.chown = true
+	}
+}
+
+// NewLocalHandler returns a Handler serving the directory root
+func NewLocalHandler(root string, opts ...LocalOption) (*LocalHandler, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := r.Stat(".")
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	if !fi.IsDir() {
+		_ = r.Close()
+		return nil, &fs.PathError{Op: "open", Path: root, Err: errors.New("not a directory")}
+	}
+	h := &LocalHandler{root: r, dir: root}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h, nil
+}
+
+// Close releases the root directory
+func (h *LocalHandler) Close() error {
+	return h.root.Close()
+}
+
+// rel maps name to a name relative to root
+func rel(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return filepath.FromSlash(name)
+}
+
+// err reports a failed operation on names as fs.ErrPermission when one of them leaves root
+func (h *LocalHandler) err(err error, names ...string) error {
+	if err == nil {
+		return nil
+	}
+	for _, name := range names {
+		if h.escapes(rel(name)) {
+			return fmt.Errorf("%w: %w", fs.ErrPermission, err)
+		}
+	}
+	return err
+}
+
+// escapes reports whether resolving the symbolic links in p, relative to root, leaves root.
+// Absolute targets are never followed within root, so count as leaving it.
+func (h *LocalHandler) escapes(p string) bool {
+	var resolved []string
+	parts := strings.Split(filepath.ToSlash(p), "/")
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return true
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		target, err := h.root.Readlink(filepath.Join(append(resolved, part)...))
+		if err != nil {
+			// not a link, or missing, which the operation itself reports
+			resolved = append(resolved, part)
+			continue
+		}
+		if links++; links > maxLinkDepth {
+			return false
+		}
+		if filepath.IsAbs(target) {
+			return true
+		}
+		parts = append(strings.Split(filepath.ToSlash(target), "/"), parts...)
+	}
+	return false
+}
+
+func (h *LocalHandler) Open(name string, pflags uint32, attrs usftp.Attrs) (File, error) {
+	flag := 0
+	switch {
+	case pflags&usftp.SSH_FXF_READ != 0 && pflags&usftp.SSH_FXF_WRITE != 0:
+		flag = os.O_RDWR
+	case pflags&usftp.SSH_FXF_WRITE != 0:
+		flag = os.O_WRONLY
+	default:
+		flag = os.O_RDONLY
+	}
+	if pflags&usftp.SSH_FXF_APPEND != 0 {
+		flag |= os.O_APPEND
+	}
+	if pflags&usftp.SSH_FXF_CREAT != 0 {
+		flag |= os.O_CREATE
+	}
+	if pflags&usftp.SSH_FXF_TRUNC != 0 {
+		flag |= os.O_TRUNC
+	}
+	if pflags&usftp.SSH_FXF_EXCL != 0 {
+		flag |= os.O_EXCL
+	}
+	perm := fs.FileMode(0644)
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		perm = attrs.Permissions.FsFileMode().Perm()
+	}
+	f, err := h.root.OpenFile(rel(name), flag, perm)
+	if err != nil {
+		return nil, h.err(err, name)
+	}
+	return &localFile{File: f, h: h, name: name, append: pflags&usftp.SSH_FXF_APPEND != 0}, nil
+}
+
+func (h *LocalHandler) ReadDir(name string) ([]*usftp.NameRespFile, error) {
+	d, err := h.OpenDir(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = d.Close() }()
+	var names []*usftp.NameRespFile
+	for {
+		batch, err := d.ReadDir(readDirBatch)
+		names = append(names, batch...)
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// OpenDir opens the directory name to be listed in batches
+func (h *LocalHandler) OpenDir(name string) (Dir, error) {
+	f, err := h.root.Open(rel(name))
+	if err != nil {
+		return nil, h.err(err, name)
+	}
+	return &localDir{File: f, h: h, name: name}, nil
+}
+
+func (d *localDir) ReadDir(n int) ([]*usftp.NameRespFile, error) {
+	for {
+		entries, err := d.File.ReadDir(n)
+		var names []*usftp.NameRespFile
+		for _, e := range entries {
+			fi, err := d.h.root.Lstat(rel(path.Join(d.name, e.Name())))
+			if err != nil {
+				// removed since the directory was read
+				continue
+			}
+			names = append(names, &usftp.NameRespFile{Filename: e.Name(), Attrs: usftp.FileInfoAttrs(fi)})
+		}
+		// an empty batch is only returned at the end of the directory
+		if len(names) > 0 || len(entries) == 0 || err != nil {
+			return names, err
+		}
+	}
+}
+
+func (h *LocalHandler) Stat(name string) (usftp.Attrs, error) {
+	fi, err := h.root.Stat(rel(name))
+	if err != nil {
+		return usftp.Attrs{}, h.err(err, name)
+	}
+	return usftp.FileInfoAttrs(fi), nil
+}
+
+func (h *LocalHandler) Lstat(name string) (usftp.Attrs, error) {
+	fi, err := h.root.Lstat(rel(name))
+	if err != nil {
+		return usftp.Attrs{}, h.err(err, name)
+	}
+	return usftp.FileInfoAttrs(fi), nil
+}
+
+func (h *LocalHandler) Setstat(name string, attrs usftp.Attrs) error {
+	if err := h.checkChown(attrs); err != nil {
+		return err
+	}
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_SIZE != 0 {
+		f, err := h.root.OpenFile(rel(name), os.O_WRONLY, 0)
+		if err != nil {
+			return h.err(err, name)
+		}
+		err = f.Truncate(int64(attrs.Size))
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return h.setstat(name, attrs)
+}
+
+// checkChown refuses a change of owner unless enabled with WithChown
+func (h *LocalHandler) checkChown(attrs usftp.Attrs) error {
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_UIDGID != 0 && !h.chown {
+		return fs.ErrPermission
+	}
+	return nil
+}
+
+// setstat applies the permissions, ownership and times in attrs to name
+func (h *LocalHandler) setstat(name string, attrs usftp.Attrs) error {
+	p := rel(name)
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		if err := h.root.Chmod(p, attrs.Permissions.FsFileMode().Perm()); err != nil {
+			return h.err(err, name)
+		}
+	}
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_UIDGID != 0 {
+		if err := h.root.Chown(p, int(attrs.Uid), int(attrs.Gid)); err != nil {
+			return h.err(err, name)
+		}
+	}
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_ACMODTIME != 0 {
+		if err := h.root.Chtimes(p, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return h.err(err, name)
+		}
+	}
+	return nil
+}
+
+func (h *LocalHandler) Remove(name string) error {
+	fi, err := h.root.Lstat(rel(name))
+	if err != nil {
+		return h.err(err, name)
+	}
+	if fi.IsDir() {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("is a directory")}
+	}
+	return h.err(h.root.Remove(rel(name)), name)
+}
+
+func (h *LocalHandler) Rename(oldName string, newName string) error {
+	if _, err := h.root.Lstat(rel(newName)); err == nil {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	}
+	return h.PosixRename(oldName, newName)
+}
+
+func (h *LocalHandler) PosixRename(oldName string, newName string) error {
+	return h.err(h.root.Rename(rel(oldName), rel(newName)), oldName, newName)
+}
+
+func (h *LocalHandler) Mkdir(name string, attrs usftp.Attrs) error {
+	perm := fs.FileMode(0755)
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		perm = attrs.Permissions.FsFileMode().Perm()
+	}
+	return h.err(h.root.Mkdir(rel(name), perm), name)
+}
+
+func (h *LocalHandler) Rmdir(name string) error {
+	p := rel(name)
+	if p == "." {
+		return fs.ErrPermission
+	}
+	fi, err := h.root.Lstat(p)
+	if err != nil {
+		return h.err(err, name)
+	}
+	if !fi.IsDir() {
+		return &fs.PathError{Op: "rmdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return h.err(h.root.Remove(p), name)
+}
+
+// Readlink returns the target of the link name. Targets outside of root are refused with
+// fs.ErrPermission, and absolute targets within it are returned relative to root as clients
+// see it.
+func (h *LocalHandler) Readlink(name string) (string, error) {
+	target, err := h.root.Readlink(rel(name))
+	if err != nil {
+		return "", h.err(err, name)
+	}
+	if filepath.IsAbs(target) {
+		r, err := filepath.Rel(h.dir, target)
+		if err != nil || !filepath.IsLocal(r) {
+			return "", fs.ErrPermission
+		}
+		return path.Join("/", filepath.ToSlash(r)), nil
+	}
+	target = filepath.ToSlash(target)
+	// relative to the directory holding the link, which is below root
+	if r := path.Join(strings.TrimPrefix(path.Dir(path.Clean("/"+name)), "/"), target); r != "." && !filepath.IsLocal(r) {
+		return "", fs.ErrPermission
+	}
+	return target, nil
+}
+
+// Symlink creates name pointing at target. Targets are resolved within root when followed, so
+// links leaving root can be created but not used.
+func (h *LocalHandler) Symlink(target string, name string) error {
+	return h.err(h.root.Symlink(filepath.FromSlash(target), rel(name)), name)
+}
+
+func (f *localFile) WriteAt(b []byte, off int64) (int, error) {
+	// WriteAt is not permitted on files opened with O_APPEND
+	if f.append {
+		return f.File.Write(b)
+	}
+	return f.File.WriteAt(b, off)
+}
+
+func (f *localFile) Stat() (usftp.Attrs, error) {
+	fi, err := f.File.Stat()
+	if err != nil {
+		return usftp.Attrs{}, err
+	}
+	return usftp.FileInfoAttrs(fi), nil
+}
+
+func (f *localFile) Setstat(attrs usftp.Attrs) error {
+	if err := f.h.checkChown(attrs); err != nil {
+		return err
+	}
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_SIZE != 0 {
+		if err := f.File.Truncate(int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		if err := f.File.Chmod(attrs.Permissions.FsFileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_UIDGID != 0 {
+		if err := f.File.Chown(int(attrs.Uid), int(attrs.Gid)); err != nil {
+			return err
+		}
+	}
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_ACMODTIME != 0 {
+		// there is no Chtimes for an open file, the name is resolved within root
+		return f.h.err(f.h.root.Chtimes(rel(f.name), time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)), f.name)
+	}
+	return nil
+}
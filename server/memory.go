@@ -0,0 +1,532 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardjennings/usftp"
+)
+
+// DefaultMaxFileSize is the largest file a MemHandler holds unless set with WithMaxFileSize
+const DefaultMaxFileSize = 256 << 20
+
+// maxLinkDepth bounds the number of symbolic links followed while resolving a name
+const maxLinkDepth = 40
+
+// ErrFileTooLarge is returned by writes and truncates beyond the maximum size of a file, and is
+// reported to the client as SSH_FX_FAILURE
+var ErrFileTooLarge = errors.New("file too large")
+
+var (
+	errNotDir     = errors.New("not a directory")
+	errIsDir      = errors.New("is a directory")
+	errNotEmpty   = errors.New("directory not empty")
+	errLinkLoop   = errors.New("too many levels of symbolic links")
+	errInvalidArg = errors.New("invalid argument")
+)
+
+type (
+	// MemHandler is a Handler backed by an in-memory filesystem. It supports directories,
+	// regular files and symbolic links, and is safe for concurrent use.
+	MemHandler struct {
+		mu          sync.RWMutex
+		root        *memNode
+		maxFileSize uint64
+	}
+
+	// MemOption configures a MemHandler
+	MemOption func(*MemHandler)
+
+	memNode struct {
+		mode     usftp.FileMode
+		uid      uint32
+		gid      uint32
+		atime    uint32
+		mtime    uint32
+		data     []byte
+		target   string
+		children map[string]*memNode
+	}
+
+	memFile struct {
+		h      *MemHandler
+		n      *memNode
+		read   bool
+		write  bool
+		append bool
+	}
+)
+
+// WithMaxFileSize sets the largest file a MemHandler holds, the default is DefaultMaxFileSize.
+// Writes and truncates beyond it fail with ErrFileTooLarge rather than allocating the memory.
+func WithMaxFileSize(n uint64) MemOption {
+	return func(h *MemHandler) {
+		h.maxFileSize = n
+	}
+}
+
+func NewMemHandler(opts ...MemOption) *MemHandler {
+	h := &MemHandler{root: newMemNode(usftp.ModeDir | 0755), maxFileSize: DefaultMaxFileSize}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func newMemNode(mode usftp.FileMode) *memNode {
+	now := uint32(time.Now().Unix())
+	n := &memNode{mode: mode, atime: now, mtime: now}
+	if mode.IsDir() {
+		n.children = make(map[string]*memNode)
+	}
+	return n
+}
+
+func (n *memNode) attrs() usftp.Attrs {
+	size := uint64(len(n.data))
+	if n.mode.IsSymlink() {
+		size = uint64(len(n.target))
+	}
+	return usftp.Attrs{
+		Flags:       usftp.SSH_FILEXFER_ATTR_SIZE | usftp.SSH_FILEXFER_ATTR_UIDGID | usftp.SSH_FILEXFER_ATTR_PERMISSIONS | usftp.SSH_FILEXFER_ATTR_ACMODTIME,
+		Size:        size,
+		Uid:         n.uid,
+		Gid:         n.gid,
+		Permissions: n.mode,
+		Atime:       n.atime,
+		Mtime:       n.mtime,
+	}
+}
+
+func (n *memNode) setstat(attrs usftp.Attrs, maxFileSize uint64) error {
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_SIZE != 0 && n.mode.IsRegular() {
+		if err := n.truncate(attrs.Size, maxFileSize); err != nil {
+			return err
+		}
+	}
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_UIDGID != 0 {
+		n.uid, n.gid = attrs.Uid, attrs.Gid
+	}
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		n.mode = n.mode&usftp.ModeType | attrs.Permissions&usftp.ModePerm
+	}
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_ACMODTIME != 0 {
+		n.atime, n.mtime = attrs.Atime, attrs.Mtime
+	}
+	return nil
+}
+
+// truncate sets the size of the file, failing with ErrFileTooLarge above maxFileSize
+func (n *memNode) truncate(size uint64, maxFileSize uint64) error {
+	if size > maxFileSize {
+		return ErrFileTooLarge
+	}
+	if size <= uint64(len(n.data)) {
+		n.data = n.data[:size]
+	} else {
+		n.data = append(n.data, make([]byte, size-uint64(len(n.data)))...)
+	}
+	n.mtime = uint32(time.Now().Unix())
+	return nil
+}
+
+// contains reports whether d is n or a directory below it
+func (n *memNode) contains(d *memNode) bool {
+	if n == d {
+		return true
+	}
+	for _, c := range n.children {
+		if c.mode.IsDir() && c.contains(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the node for name. Links in parent directories are always followed, and a
+// link in the final element only when follow is set.
+func (h *MemHandler) lookup(name string, follow bool) (*memNode, error) {
+	return h.lookupDepth(name, follow, 0)
+}
+
+func (h *MemHandler) lookupDepth(name string, follow bool, depth int) (*memNode, error) {
+	if depth > maxLinkDepth {
+		return nil, &fs.PathError{Op: "lookup", Path: name, Err: errLinkLoop}
+	}
+	parts := split(name)
+	n := h.root
+	for i, part := range parts {
+		if !n.mode.IsDir() {
+			return nil, &fs.PathError{Op: "lookup", Path: name, Err: errNotDir}
+		}
+		c, ok := n.children[part]
+		if !ok {
+			return nil, &fs.PathError{Op: "lookup", Path: name, Err: fs.ErrNotExist}
+		}
+		if c.mode.IsSymlink() && (i < len(parts)-1 || follow) {
+			target := c.target
+			if !path.IsAbs(target) {
+				target = path.Join("/", strings.Join(parts[:i], "/"), target)
+			}
+			rest := path.Join(append([]string{target}, parts[i+1:]...)...)
+			return h.lookupDepth(rest, follow, depth+1)
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// parent returns the directory containing name and the final element of name
+func (h *MemHandler) parent(name string) (*memNode, string, error) {
+	if name == "/" {
+		return nil, "", &fs.PathError{Op: "lookup", Path: name, Err: fs.ErrPermission}
+	}
+	dir, err := h.lookup(path.Dir(name), true)
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.mode.IsDir() {
+		return nil, "", &fs.PathError{Op: "lookup", Path: name, Err: errNotDir}
+	}
+	return dir, path.Base(name), nil
+}
+
+func split(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+func (h *MemHandler) Open(name string, pflags uint32, attrs usftp.Attrs) (File, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dir, base, err := h.parent(name)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := dir.children[base]
+	switch {
+	case ok && pflags&usftp.SSH_FXF_CREAT != 0 && pflags&usftp.SSH_FXF_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case ok && n.mode.IsSymlink():
+		if n, err = h.lookup(name, true); err != nil {
+			return nil, err
+		}
+	case !ok && pflags&usftp.SSH_FXF_CREAT == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !ok:
+		perm := usftp.FileMode(0644)
+		if attrs.Flags&usftp.SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+			perm = attrs.Permissions & usftp.ModePerm
+		}
+		n = newMemNode(usftp.ModeRegular | perm)
+		dir.children[base] = n
+	}
+	if n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	f := &memFile{
+		h:      h,
+		n:      n,
+		read:   pflags&usftp.SSH_FXF_READ != 0,
+		write:  pflags&usftp.SSH_FXF_WRITE != 0,
+		append: pflags&usftp.SSH_FXF_APPEND != 0,
+	}
+	if f.write && pflags&usftp.SSH_FXF_TRUNC != 0 {
+		_ = n.truncate(0, h.maxFileSize)
+	}
+	return f, nil
+}
+
+func (h *MemHandler) ReadDir(name string) ([]*usftp.NameRespFile, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n, err := h.lookup(name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDir}
+	}
+	var names []*usftp.NameRespFile
+	for k, c := range n.children {
+		names = append(names, &usftp.NameRespFile{Filename: k, Attrs: c.attrs()})
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].Filename < names[j].Filename
+	})
+	return names, nil
+}
+
+func (h *MemHandler) Stat(name string) (usftp.Attrs, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n, err := h.lookup(name, true)
+	if err != nil {
+		return usftp.Attrs{}, err
+	}
+	return n.attrs(), nil
+}
+
+func (h *MemHandler) Lstat(name string) (usftp.Attrs, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n, err := h.lookup(name, false)
+	if err != nil {
+		return usftp.Attrs{}, err
+	}
+	return n.attrs(), nil
+}
+
+func (h *MemHandler) Setstat(name string, attrs usftp.Attrs) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, err := h.lookup(name, true)
+	if err != nil {
+		return err
+	}
+	return n.setstat(attrs, h.maxFileSize)
+}
+
+func (h *MemHandler) Remove(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dir, base, err := h.parent(name)
+	if err != nil {
+		return err
+	}
+	n, ok := dir.children[base]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.mode.IsDir() {
+		return &fs.PathError{Op: "remove", Path: name, Err: errIsDir}
+	}
+	delete(dir.children, base)
+	return nil
+}
+
+func (h *MemHandler) Rename(oldName string, newName string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.lookup(newName, false); err == nil {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	}
+	return h.rename(oldName, newName)
+}
+
+func (h *MemHandler) PosixRename(oldName string, newName string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rename(oldName, newName)
+}
+
+func (h *MemHandler) rename(oldName string, newName string) error {
+	oldDir, oldBase, err := h.parent(oldName)
+	if err != nil {
+		return err
+	}
+	n, ok := oldDir.children[oldBase]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	newDir, newBase, err := h.parent(newName)
+	if err != nil {
+		return err
+	}
+	// compare nodes rather than names, newName may reach below oldName through a link
+	if n.mode.IsDir() && n.contains(newDir) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: errInvalidArg}
+	}
+	if existing, ok := newDir.children[newBase]; ok {
+		switch {
+		case existing == n:
+			return nil
+		case existing.mode.IsDir() && !n.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: newName, Err: errIsDir}
+		case !existing.mode.IsDir() && n.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: newName, Err: errNotDir}
+		case existing.mode.IsDir() && len(existing.children) > 0:
+			return &fs.PathError{Op: "rename", Path: newName, Err: errNotEmpty}
+		}
+	}
+	delete(oldDir.children, oldBase)
+	newDir.children[newBase] = n
+	return nil
+}
+
+func (h *MemHandler) Mkdir(name string, attrs usftp.Attrs) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dir, base, err := h.parent(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.children[base]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	perm := usftp.FileMode(0755)
+	if attrs.Flags&usftp.SSH_FILEXFER_ATTR_PERMISSIONS != 0 {
+		perm = attrs.Permissions & usftp.ModePerm
+	}
+	dir.children[base] = newMemNode(usftp.ModeDir | perm)
+	return nil
+}
+
+func (h *MemHandler) Rmdir(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dir, base, err := h.parent(name)
+	if err != nil {
+		return err
+	}
+	n, ok := dir.children[base]
+	switch {
+	case !ok:
+		return &fs.PathError{Op: "rmdir", Path: name, Err: fs.ErrNotExist}
+	case !n.mode.IsDir():
+		return &fs.PathError{Op: "rmdir", Path: name, Err: errNotDir}
+	case len(n.children) > 0:
+		return &fs.PathError{Op: "rmdir", Path: name, Err: errNotEmpty}
+	}
+	delete(dir.children, base)
+	return nil
+}
+
+func (h *MemHandler) Readlink(name string) (string, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n, err := h.lookup(name, false)
+	if err != nil {
+		return "", err
+	}
+	if !n.mode.IsSymlink() {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errInvalidArg}
+	}
+	return n.target, nil
+}
+
+func (h *MemHandler) Symlink(target string, name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dir, base, err := h.parent(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.children[base]; ok {
+		return &fs.PathError{Op: "symlink", Path: name, Err: fs.ErrExist}
+	}
+	n := newMemNode(usftp.ModeSymlink | 0777)
+	n.target = target
+	dir.children[base] = n
+	return nil
+}
+
+// MkdirAll creates the directory name along with any missing parents
+func (h *MemHandler) MkdirAll(name string, perm fs.FileMode) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.mkdirAll(name, perm)
+	return err
+}
+
+func (h *MemHandler) mkdirAll(name string, perm fs.FileMode) (*memNode, error) {
+	n := h.root
+	for _, part := range split(name) {
+		c, ok := n.children[part]
+		if !ok {
+			c = newMemNode(usftp.ModeDir | usftp.FileMode(perm.Perm()))
+			n.children[part] = c
+		}
+		if !c.mode.IsDir() {
+			return nil, &fs.PathError{Op: "mkdir", Path: name, Err: errNotDir}
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// WriteFile creates or replaces the file name with data, creating missing parent directories
+// with mode 0755. It is intended for seeding the filesystem.
+func (h *MemHandler) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dir, err := h.mkdirAll(path.Dir(path.Clean("/"+name)), 0755)
+	if err != nil {
+		return err
+	}
+	n := newMemNode(usftp.ModeRegular | usftp.FileMode(perm.Perm()))
+	n.data = append([]byte(nil), data...)
+	dir.children[path.Base(path.Clean("/"+name))] = n
+	return nil
+}
+
+func (f *memFile) ReadAt(b []byte, off int64) (int, error) {
+	if !f.read {
+		return 0, fs.ErrPermission
+	}
+	if off < 0 {
+		return 0, errInvalidArg
+	}
+	f.h.mu.RLock()
+	defer f.h.mu.RUnlock()
+	if off >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.n.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) WriteAt(b []byte, off int64) (int, error) {
+	if !f.write {
+		return 0, fs.ErrPermission
+	}
+	if off < 0 {
+		return 0, errInvalidArg
+	}
+	f.h.mu.Lock()
+	defer f.h.mu.Unlock()
+	if f.append {
+		off = int64(len(f.n.data))
+	}
+	if end := uint64(off) + uint64(len(b)); end > uint64(len(f.n.data)) {
+		if err := f.n.truncate(end, f.h.maxFileSize); err != nil {
+			return 0, err
+		}
+	}
+	copy(f.n.data[off:], b)
+	f.n.mtime = uint32(time.Now().Unix())
+	return len(b), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+// Sync has nothing to flush, it allows fsync@openssh.com to succeed
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Stat() (usftp.Attrs, error) {
+	f.h.mu.RLock()
+	defer f.h.mu.RUnlock()
+	return f.n.attrs(), nil
+}
+
+func (f *memFile) Setstat(attrs usftp.Attrs) error {
+	f.h.mu.Lock()
+	defer f.h.mu.Unlock()
+	return f.n.setstat(attrs, f.h.maxFileSize)
+}
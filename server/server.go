@@ -0,0 +1,500 @@
+// Package server implements the server side of SFTP version 3 on top of the usftp message types.
+// Storage is provided by a Handler, requests are read from any io.ReadWriteCloser, and
+// ServeChannels can be used to run it as the sftp subsystem of an x/crypto/ssh server.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/richardjennings/usftp"
+)
+
+type (
+	// Handler provides the storage exposed by a Server. Names are absolute, slash separated and
+	// cleaned before the Handler is called. Errors wrapping fs.ErrNotExist, fs.ErrPermission,
+	// fs.ErrExist and errors.ErrUnsupported are reported to the client with the matching status
+	// code, any other error is reported as SSH_FX_FAILURE.
+	Handler interface {
+		// Open opens or creates a file according to the SSH_FXF_* pflags. attrs holds the
+		// attributes requested for a newly created file.
+		Open(name string, pflags uint32, attrs usftp.Attrs) (File, error)
+		// ReadDir lists the entries of a directory, excluding "." and ".."
+		ReadDir(name string) ([]*usftp.NameRespFile, error)
+		Stat(name string) (usftp.Attrs, error)
+		Lstat(name string) (usftp.Attrs, error)
+		Setstat(name string, attrs usftp.Attrs) error
+		Remove(name string) error
+		// Rename fails if newName already exists
+		Rename(oldName string, newName string) error
+		Mkdir(name string, attrs usftp.Attrs) error
+		Rmdir(name string) error
+		Readlink(name string) (string, error)
+		Symlink(target string, name string) error
+	}
+
+	// File is an open file returned by Handler.Open
+	File interface {
+		io.ReaderAt
+		io.WriterAt
+		io.Closer
+		Stat() (usftp.Attrs, error)
+		Setstat(attrs usftp.Attrs) error
+	}
+
+	// PosixRenamer is implemented by Handlers that can atomically replace an existing file,
+	// and enables the posix-rename@openssh.com extension
+	PosixRenamer interface {
+		PosixRename(oldName string, newName string) error
+	}
+
+	// DirOpener is implemented by Handlers that can list a directory in batches, so that an open
+	// directory handle does not hold the whole listing. Other Handlers are listed with ReadDir.
+	DirOpener interface {
+		OpenDir(name string) (Dir, error)
+	}
+
+	// Dir is an open directory returned by DirOpener.OpenDir
+	Dir interface {
+		// ReadDir returns up to n entries, excluding "." and "..", and io.EOF once there are
+		// no more
+		ReadDir(n int) ([]*usftp.NameRespFile, error)
+		io.Closer
+	}
+
+	// Syncer is implemented by Files that can be flushed to stable storage with
+	// fsync@openssh.com
+	Syncer interface {
+		Sync() error
+	}
+
+	Server struct {
+		h             Handler
+		maxPacketSize uint32
+		maxHandles    int
+		commands      []string
+	}
+
+	// Option configures a Server
+	Option func(*Server)
+
+	// conn holds the state of a single client connection
+	conn struct {
+		s          *Server
+		nextHandle uint64
+		files      map[string]File
+		dirs       map[string]*openDir
+	}
+
+	// openDir is a directory handle, dots holds "." and ".." until the first SSH_FXP_READDIR
+	openDir struct {
+		Dir
+		dots []*usftp.NameRespFile
+	}
+
+	// sliceDir is a Dir over a listing read in full by Handler.ReadDir
+	sliceDir []*usftp.NameRespFile
+)
+
+const (
+	extPosixRename = "posix-rename@openssh.com"
+	extFsync       = "fsync@openssh.com"
+
+	// readDirBatch is the number of names returned for each SSH_FXP_READDIR
+	readDirBatch = 100
+
+	// DefaultMaxHandles is the number of files and directories a client may have open at once
+	// unless set with WithMaxHandles
+	DefaultMaxHandles = 256
+
+	// minPacketSize is the smallest packet all implementations are required to support
+	minPacketSize = 34000
+	// packetOverhead is room left for the header of a data response within the packet size
+	packetOverhead = 1024
+)
+
+// errTooManyHandles is returned when a client opens more than the maximum number of handles
+var errTooManyHandles = errors.New("too many open handles")
+
+// WithMaxPacketSize sets the largest packet the Server will accept from a client, and bounds
+// the amount of data returned for a single read. Sizes below 34000 bytes, the least the
+// protocol requires, are raised to it.
+func WithMaxPacketSize(n uint32) Option {
+	return func(s *Server) {
+		s.maxPacketSize = max(n, minPacketSize)
+	}
+}
+
+// WithMaxHandles sets the number of files and directories a client may have open at once.
+// Opening more fails with SSH_FX_FAILURE until a handle is closed.
+func WithMaxHandles(n int) Option {
+	return func(s *Server) {
+		s.maxHandles = n
+	}
+}
+
+// WithExecCommands serves SFTP for "exec" requests running one of commands, in the same way
+// as the sftp subsystem, for clients that start the server by executing sftp-server
+func WithExecCommands(commands ...string) Option {
+	return func(s *Server) {
+		s.commands = append(s.commands, commands...)
+	}
+}
+
+func New(h Handler, opts ...Option) *Server {
+	s := &Server{h: h, maxPacketSize: usftp.DefaultMaxPacketSize, maxHandles: DefaultMaxHandles}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Serve reads requests from rwc and writes responses until the client disconnects. Requests
+// are handled in the order they are received. rwc is closed when Serve returns.
+func (s *Server) Serve(rwc io.ReadWriteCloser) error {
+	c := &conn{s: s, files: make(map[string]File), dirs: make(map[string]*openDir)}
+	defer func() { _ = rwc.Close() }()
+	defer c.closeAll()
+	for {
+		t, payload, err := usftp.ReadPacket(rwc, s.maxPacketSize)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var resp usftp.Msg
+		if msg, err := usftp.DecodeMsg(t, payload); err != nil {
+			if resp = undecoded(t, payload, err); resp == nil {
+				return err
+			}
+		} else {
+			resp = c.handle(msg)
+		}
+		if resp == nil {
+			continue
+		}
+		if err := usftp.WriteMsg(rwc, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// readLength is the most data returned for a single read, leaving room for the packet header
+// within the maximum packet size
+func (s *Server) readLength() uint32 {
+	if s.maxPacketSize <= packetOverhead {
+		return minPacketSize - packetOverhead
+	}
+	return s.maxPacketSize - packetOverhead
+}
+
+func (c *conn) closeAll() {
+	for _, f := range c.files {
+		_ = f.Close()
+	}
+	for _, d := range c.dirs {
+		_ = d.Close()
+	}
+	c.files = nil
+	c.dirs = nil
+}
+
+// newHandle returns a new handle, failing with errTooManyHandles once the client has the
+// maximum number open
+func (c *conn) newHandle() (string, error) {
+	if len(c.files)+len(c.dirs) >= c.s.maxHandles {
+		return "", errTooManyHandles
+	}
+	c.nextHandle++
+	return strconv.FormatUint(c.nextHandle, 10), nil
+}
+
+func (c *conn) handle(msg usftp.Msg) usftp.Msg {
+	h := c.s.h
+	switch m := msg.(type) {
+	case *usftp.InitReq:
+		resp := &usftp.VersionResp{Version: 3, Extensions: []usftp.Extension{{Name: extFsync, Data: "1"}}}
+		if _, ok := h.(PosixRenamer); ok {
+			resp.Extensions = append(resp.Extensions, usftp.Extension{Name: extPosixRename, Data: "1"})
+		}
+		return resp
+	case *usftp.OpenReq:
+		handle, err := c.newHandle()
+		if err != nil {
+			return status(m.Id, err)
+		}
+		f, err := h.Open(clean(m.Filename), m.Pflags, m.Attrs)
+		if err != nil {
+			return status(m.Id, err)
+		}
+		c.files[handle] = f
+		return &usftp.HandleResp{Header: m.Header, Handle: handle}
+	case *usftp.CloseReq:
+		if f, ok := c.files[m.Handle]; ok {
+			delete(c.files, m.Handle)
+			return status(m.Id, f.Close())
+		}
+		if d, ok := c.dirs[m.Handle]; ok {
+			delete(c.dirs, m.Handle)
+			return status(m.Id, d.Close())
+		}
+		return badHandle(m.Id)
+	case *usftp.ReadReq:
+		f, ok := c.files[m.Handle]
+		if !ok {
+			return badHandle(m.Id)
+		}
+		b := make([]byte, min(m.Len, c.s.readLength()))
+		n, err := f.ReadAt(b, int64(m.Offset))
+		if n == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return status(m.Id, err)
+		}
+		return &usftp.DataResp{Header: m.Header, Data: b[:n]}
+	case *usftp.WriteReq:
+		f, ok := c.files[m.Handle]
+		if !ok {
+			return badHandle(m.Id)
+		}
+		_, err := f.WriteAt(m.Data, int64(m.Offset))
+		return status(m.Id, err)
+	case *usftp.FstatReq:
+		f, ok := c.files[m.Handle]
+		if !ok {
+			return badHandle(m.Id)
+		}
+		return attrs(m.Id)(f.Stat())
+	case *usftp.FsetstatReq:
+		f, ok := c.files[m.Handle]
+		if !ok {
+			return badHandle(m.Id)
+		}
+		return status(m.Id, f.Setstat(m.Attrs))
+	case *usftp.OpenDirReq:
+		handle, err := c.newHandle()
+		if err != nil {
+			return status(m.Id, err)
+		}
+		d, err := c.openDir(clean(m.Path))
+		if err != nil {
+			return status(m.Id, err)
+		}
+		c.dirs[handle] = d
+		return &usftp.HandleResp{Header: m.Header, Handle: handle}
+	case *usftp.ReadDirReq:
+		d, ok := c.dirs[m.Handle]
+		if !ok {
+			return badHandle(m.Id)
+		}
+		names, err := d.next()
+		if len(names) == 0 {
+			if err == nil {
+				err = io.EOF
+			}
+			return status(m.Id, err)
+		}
+		return &usftp.NameResp{Header: m.Header, Count: uint32(len(names)), Names: names}
+	case *usftp.StatReq:
+		return attrs(m.Id)(h.Stat(clean(m.Path)))
+	case *usftp.LstatReq:
+		return attrs(m.Id)(h.Lstat(clean(m.Path)))
+	case *usftp.SetstatReq:
+		return status(m.Id, h.Setstat(clean(m.Path), m.Attrs))
+	case *usftp.RemoveReq:
+		return status(m.Id, h.Remove(clean(m.Filename)))
+	case *usftp.RenameReq:
+		return status(m.Id, h.Rename(clean(m.OldPath), clean(m.NewPath)))
+	case *usftp.MkdirReq:
+		return status(m.Id, h.Mkdir(clean(m.Path), m.Attrs))
+	case *usftp.RmdirReq:
+		return status(m.Id, h.Rmdir(clean(m.Path)))
+	case *usftp.RealpathReq:
+		name := clean(m.Path)
+		return &usftp.NameResp{Header: m.Header, Count: 1, Names: []*usftp.NameRespFile{{Filename: name, Longname: name}}}
+	case *usftp.ReadlinkReq:
+		target, err := h.Readlink(clean(m.Path))
+		if err != nil {
+			return status(m.Id, err)
+		}
+		return &usftp.NameResp{Header: m.Header, Count: 1, Names: []*usftp.NameRespFile{{Filename: target, Longname: target}}}
+	case *usftp.SymlinkReq:
+		// the target is not cleaned, a relative target is relative to the link
+		return status(m.Id, h.Symlink(m.TargetPath, clean(m.LinkPath)))
+	case *usftp.ExtendedReq:
+		return c.extended(m)
+	default:
+		// responses sent by a misbehaving client are ignored
+		return nil
+	}
+}
+
+func (c *conn) extended(m *usftp.ExtendedReq) usftp.Msg {
+	switch m.Request {
+	case extPosixRename:
+		r, ok := c.s.h.(PosixRenamer)
+		if !ok {
+			break
+		}
+		oldName, b, err := usftp.String(m.Data)
+		if err != nil {
+			return status(m.Id, err)
+		}
+		newName, _, err := usftp.String(b)
+		if err != nil {
+			return status(m.Id, err)
+		}
+		return status(m.Id, r.PosixRename(clean(oldName), clean(newName)))
+	case extFsync:
+		handle, _, err := usftp.String(m.Data)
+		if err != nil {
+			return status(m.Id, err)
+		}
+		f, ok := c.files[handle]
+		if !ok {
+			return badHandle(m.Id)
+		}
+		s, ok := f.(Syncer)
+		if !ok {
+			break
+		}
+		return status(m.Id, s.Sync())
+	}
+	return status(m.Id, errors.ErrUnsupported)
+}
+
+// readDir lists name, prefixed with "." and ".." entries as OpenSSH does
+// openDir opens the directory name, with DirOpener when the Handler implements it
+func (c *conn) openDir(name string) (*openDir, error) {
+	self, err := c.s.h.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := c.s.h.Stat(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	var d Dir
+	if o, ok := c.s.h.(DirOpener); ok {
+		d, err = o.OpenDir(name)
+	} else {
+		var entries []*usftp.NameRespFile
+		entries, err = c.s.h.ReadDir(name)
+		s := sliceDir(entries)
+		d = &s
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &openDir{Dir: d, dots: []*usftp.NameRespFile{{Filename: ".", Attrs: self}, {Filename: "..", Attrs: parent}}}, nil
+}
+
+// next returns the next batch of at most readDirBatch names, with "." and ".." first
+func (d *openDir) next() ([]*usftp.NameRespFile, error) {
+	names := d.dots
+	d.dots = nil
+	entries, err := d.ReadDir(readDirBatch - len(names))
+	names = append(names, entries...)
+	if len(names) > 0 && err == io.EOF {
+		// reported by the following request
+		err = nil
+	}
+	for _, n := range names {
+		if n.Longname == "" {
+			n.Longname = Longname(n.Filename, n.Attrs)
+		}
+	}
+	return names, err
+}
+
+func (d *sliceDir) ReadDir(n int) ([]*usftp.NameRespFile, error) {
+	if len(*d) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(*d))
+	names := (*d)[:n]
+	*d = (*d)[n:]
+	return names, nil
+}
+
+func (d *sliceDir) Close() error {
+	return nil
+}
+
+// Longname formats attrs in the style of ls -l, as used for the longname field of
+// SSH_FXP_NAME
+func Longname(name string, attrs usftp.Attrs) string {
+	mtime := time.Unix(int64(attrs.Mtime), 0).UTC()
+	format := "Jan _2 15:04"
+	if time.Since(mtime) > 180*24*time.Hour {
+		format = "Jan _2  2006"
+	}
+	return fmt.Sprintf("%s    1 %-8d %-8d %8d %s %s", attrs.Permissions, attrs.Uid, attrs.Gid, attrs.Size, mtime.Format(format), name)
+}
+
+func clean(name string) string {
+	return path.Join("/", name)
+}
+
+func attrs(id uint32) func(usftp.Attrs, error) usftp.Msg {
+	return func(a usftp.Attrs, err error) usftp.Msg {
+		if err != nil {
+			return status(id, err)
+		}
+		return &usftp.AttrsResp{Header: usftp.Header{Id: id}, Attrs: a}
+	}
+}
+
+// undecoded answers a request which was read in full but could not be decoded, with
+// SSH_FX_OP_UNSUPPORTED for an unknown type or SSH_FX_BAD_MESSAGE. It returns nil when there is
+// no request id to answer, and the client must be disconnected.
+func undecoded(t uint8, payload []byte, err error) usftp.Msg {
+	if t == usftp.SSH_FXP_INIT {
+		return nil
+	}
+	id, _, idErr := usftp.Uint32(payload)
+	if idErr != nil {
+		return nil
+	}
+	return status(id, err)
+}
+
+func badHandle(id uint32) usftp.Msg {
+	return &usftp.StatusResp{Header: usftp.Header{Id: id}, ErrorCode: usftp.SSH_FX_FAILURE, ErrorMessage: "invalid handle"}
+}
+
+// status maps err to a StatusResp. Messages are generic so that details of the backing
+// storage, such as local paths, are not disclosed.
+func status(id uint32, err error) usftp.Msg {
+	r := &usftp.StatusResp{Header: usftp.Header{Id: id}}
+	switch {
+	case err == nil:
+		r.ErrorCode, r.ErrorMessage = usftp.SSH_FX_OK, "Success"
+	case errors.Is(err, io.EOF):
+		r.ErrorCode, r.ErrorMessage = usftp.SSH_FX_EOF, "End of file"
+	case errors.Is(err, fs.ErrNotExist):
+		r.ErrorCode, r.ErrorMessage = usftp.SSH_FX_NO_SUCH_FILE, "No such file"
+	case errors.Is(err, fs.ErrPermission):
+		r.ErrorCode, r.ErrorMessage = usftp.SSH_FX_PERMISSION_DENIED, "Permission denied"
+	case errors.Is(err, errors.ErrUnsupported):
+		r.ErrorCode, r.ErrorMessage = usftp.SSH_FX_OP_UNSUPPORTED, "Operation unsupported"
+	case errors.Is(err, usftp.ErrMalformedPacket):
+		r.ErrorCode, r.ErrorMessage = usftp.SSH_FX_BAD_MESSAGE, "Bad message"
+	case errors.Is(err, errTooManyHandles):
+		r.ErrorCode, r.ErrorMessage = usftp.SSH_FX_FAILURE, "Too many open handles"
+	case errors.Is(err, ErrFileTooLarge):
+		r.ErrorCode, r.ErrorMessage = usftp.SSH_FX_FAILURE, "File too large"
+	case errors.Is(err, fs.ErrExist):
+		r.ErrorCode, r.ErrorMessage = usftp.SSH_FX_FAILURE, "File exists"
+	default:
+		r.ErrorCode, r.ErrorMessage = usftp.SSH_FX_FAILURE, "Failure"
+	}
+	return r
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/binary"
+
+	"github.com/richardjennings/usftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ServeChannels accepts session channels from an ssh.ServerConn and serves the sftp subsystem
+// on each of them. Other channel types are rejected. It returns when chans is closed.
+func (s *Server) ServeChannels(chans <-chan ssh.NewChannel) {
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() { _ = s.ServeChannel(ch, reqs) }()
+	}
+}
+
+// ServeChannel waits for the "subsystem" request for sftp on an ssh session channel, or an
+// "exec" request for one of the commands given to WithExecCommands, then serves the protocol
+// over the channel until the client disconnects. Any other request is rejected.
+func (s *Server) ServeChannel(ch ssh.Channel, reqs <-chan *ssh.Request) error {
+	for req := range reqs {
+		name, _, _ := usftp.String(req.Payload)
+		if !(req.Type == "subsystem" && name == "sftp") && !(req.Type == "exec" && s.isExecCommand(name)) {
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+			continue
+		}
+		if req.WantReply {
+			_ = req.Reply(true, nil)
+		}
+		go ssh.DiscardRequests(reqs)
+		return s.serveChannel(ch)
+	}
+	return ch.Close()
+}
+
+func (s *Server) isExecCommand(command string) bool {
+	for _, c := range s.commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serveChannel(ch ssh.Channel) error {
+	err := s.Serve(&channel{ch})
+	code := uint32(0)
+	if err != nil {
+		code = 1
+	}
+	_, _ = ch.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, code))
+	_ = ch.Close()
+	return err
+}
+
+// channel closes only the write side of the ssh channel when Serve returns, allowing the
+// exit-status to be sent afterwards
+type channel struct {
+	ssh.Channel
+}
+
+func (c *channel) Close() error {
+	return c.CloseWrite()
+}
@@ -1,94 +1,256 @@
 package usftp
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
 	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
 	"sort"
+	"sync"
 	"sync/atomic"
 )
 
 type (
 	Session struct {
-		s      *ssh.Session
-		r      reader
-		w      writer
-		ctx    context.Context
-		cancel context.CancelFunc
-		seq    uint32
+		closers []io.Closer
+		r       reader
+		w       writer
+		ctx     context.Context
+		cancel  context.CancelFunc
+		seq     uint32
+		// extensions advertised by the server in SSH_FXP_VERSION
+		extensions []Extension
+		limiter    *RateLimiter
+
+		closeMtx sync.Mutex
+		closed   bool
+		closeErr error
+	}
+
+	// SessionOption configures a Session
+	SessionOption func(*sessionOptions)
+
+	sessionOptions struct {
+		maxPacketSize uint32
+		command       string
+		limiter       *RateLimiter
 	}
+
+	closerFunc func() error
 )
 
-func NewSession(c *ssh.Client) (*Session, error) {
+// WithMaxPacketSize sets the largest packet the Session will accept from the server. Packets
+// announcing a larger length are rejected before any memory is allocated for them.
+func WithMaxPacketSize(n uint32) SessionOption {
+	return func(o *sessionOptions) {
+		o.maxPacketSize = n
+	}
+}
+
+// WithCommand starts SFTP by executing command on the server, for example
+// /usr/lib/openssh/sftp-server, rather than requesting the sftp subsystem. This allows
+// connecting to hosts where the subsystem is disabled.
+func WithCommand(command string) SessionOption {
+	return func(o *sessionOptions) {
+		o.command = command
+	}
+}
+
+func newSessionOptions(opts []SessionOption) sessionOptions {
+	o := sessionOptions{maxPacketSize: DefaultMaxPacketSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+func NewSession(c *ssh.Client, opts ...SessionOption) (*Session, error) {
+	o := newSessionOptions(opts)
+
 	session, err := c.NewSession()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := session.RequestSubsystem("sftp"); err != nil {
+	w, err := session.StdinPipe()
+	if err != nil {
+		_ = session.Close()
 		return nil, err
 	}
 
-	w, err := session.StdinPipe()
+	r, err := session.StdoutPipe()
 	if err != nil {
+		_ = session.Close()
 		return nil, err
 	}
 
-	r, err := session.StdoutPipe()
+	if o.command != "" {
+		err = session.Start(o.command)
+	} else {
+		err = session.RequestSubsystem("sftp")
+	}
 	if err != nil {
+		_ = session.Close()
 		return nil, err
 	}
 
+	return newSession(r, w, []io.Closer{session}, o)
+}
+
+// NewSessionFromConn runs the protocol over r and w, for example an ssh.Channel or one end of a
+// net.Pipe. Close closes w, and r when it is an io.Closer.
+func NewSessionFromConn(r io.Reader, w io.WriteCloser, opts ...SessionOption) (*Session, error) {
+	closers := []io.Closer{w}
+	if c, ok := r.(io.Closer); ok && c != io.Closer(w) {
+		closers = append(closers, c)
+	}
+	return newSession(r, w, closers, newSessionOptions(opts))
+}
+
+// NewSessionFromCmd starts cmd, typically a local sftp-server binary, and runs the protocol over
+// its stdin and stdout. Close closes stdin and waits for cmd to exit.
+func NewSessionFromCmd(cmd *exec.Cmd, opts ...SessionOption) (*Session, error) {
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return newSession(r, w, []io.Closer{w, closerFunc(cmd.Wait)}, newSessionOptions(opts))
+}
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+func newSession(r io.Reader, w io.Writer, closers []io.Closer, o sessionOptions) (*Session, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	s := &Session{
-		s:      session,
-		r:      reader{r: r, rChan: make(map[uint32]chan Msg)},
-		w:      writer{w: w},
-		ctx:    ctx,
-		cancel: cancel,
+		closers: closers,
+		r:       reader{r: r, maxPacketSize: o.maxPacketSize, rChan: make(map[uint32]chan Msg), done: make(chan struct{})},
+		w:       writer{w: w, ctx: ctx},
+		ctx:     ctx,
+		cancel:  cancel,
+		limiter: o.limiter,
 	}
 
+	s.w.r = &s.r
+
 	go func() {
 		eg, ctx := errgroup.WithContext(s.ctx)
 		eg.Go(s.r.handler(s, ctx))
 		_ = eg.Wait()
 	}()
 
-	err = s.init()
-	return s, err
+	if err := s.init(); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+	return s, nil
 }
 
+// Close stops the Session and closes the underlying transport, returning the first error. It is
+// safe to call more than once, and later requests fail with ErrSessionClosed.
 func (s *Session) Close() error {
+	s.w.closed.Store(true)
+	return s.shutdown()
+}
+
+// shutdown cancels the Session and closes the transport once
+func (s *Session) shutdown() error {
+	s.closeMtx.Lock()
+	defer s.closeMtx.Unlock()
+	if s.closed {
+		return s.closeErr
+	}
+	s.closed = true
 	s.cancel()
-	return s.s.Close()
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil && s.closeErr == nil {
+			s.closeErr = err
+		}
+	}
+	return s.closeErr
+}
+
+// addCloser closes c with the Session, or immediately when the Session is already closed
+func (s *Session) addCloser(c io.Closer) {
+	s.closeMtx.Lock()
+	defer s.closeMtx.Unlock()
+	if s.closed {
+		_ = c.Close()
+		return
+	}
+	s.closers = append(s.closers, c)
 }
 
 func (s *Session) nextSeq() uint32 {
-	atomic.AddUint32(&s.seq, 1)
-	return s.seq
+	return atomic.AddUint32(&s.seq, 1)
+}
+
+// recv waits for the response on read, or returns the error that stopped the reader
+func (s *Session) recv(read chan Msg) (Msg, error) {
+	select {
+	case msg := <-read:
+		return msg, nil
+	case <-s.r.done:
+		select {
+		case msg := <-read:
+			return msg, nil
+		default:
+			return nil, s.r.err
+		}
+	}
 }
 
 func (s *Session) init() error {
 	defer s.r.delChan(0)
+	c := s.r.getChan(0)
 	if err := s.w.write(&InitReq{Version: 3}); err != nil {
 		return err
 	}
-	c := s.r.getChan(0)
-	msg := <-c
+	msg, err := s.recv(c)
+	if err != nil {
+		return err
+	}
 	if msg, ok := msg.(*VersionResp); ok {
 		if msg.Version != 3 {
 			return fmt.Errorf("unhandled SFTP version: %d", msg.Version)
 		}
+		s.extensions = msg.Extensions
 	} else {
 		return fmt.Errorf("unexpected msg type: %T for InitReq", msg)
 	}
 	return nil
 }
 
+// Extensions returns the extensions advertised by the server
+func (s *Session) Extensions() []Extension {
+	return s.extensions
+}
+
+func (s *Session) hasExtension(name string) bool {
+	for _, e := range s.extensions {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Session) Ls(path string) ([]*NameRespFile, error) {
 	var names []*NameRespFile
 	id := s.nextSeq()
@@ -97,7 +259,10 @@ func (s *Session) Ls(path string) ([]*NameRespFile, error) {
 	if err := s.w.write(&OpenDirReq{Header: Header{Id: id}, Path: path}); err != nil {
 		return nil, err
 	}
-	msg := <-read
+	msg, err := s.recv(read)
+	if err != nil {
+		return nil, err
+	}
 	var handle string
 	handleResp, statusResp, err := s.handleOrStatusResp(msg)
 	switch true {
@@ -106,7 +271,7 @@ func (s *Session) Ls(path string) ([]*NameRespFile, error) {
 	case handleResp != nil:
 		handle = handleResp.Handle
 	case statusResp != nil:
-		return nil, fmt.Errorf("error: %s", statusResp.ErrorMessage)
+		return nil, statusError(statusResp)
 	}
 	cont := true
 	for cont {
@@ -121,7 +286,7 @@ func (s *Session) Ls(path string) ([]*NameRespFile, error) {
 				cont = false
 				continue
 			}
-			return nil, fmt.Errorf("error: %s", statusResp.ErrorMessage)
+			return nil, statusError(statusResp)
 		}
 	}
 	_ = s.CloseReq(id, read, handle)
@@ -182,47 +347,254 @@ func (s *Session) find(path string, parent string, visitor Visitor) ([]*NameResp
 	return files, nil
 }
 
-func (s *Session) Get(from string, out io.Writer) error {
+// Get writes the contents of from to out
+func (s *Session) Get(from string, out io.Writer, opts ...TransferOption) error {
+	t := newTransfer(from, newTransferOptions(opts))
+	defer t.finish()
+	if err := s.statTotal(t, 0, -1); err != nil {
+		return err
+	}
+	_, err := s.get(from, 0, -1, out, t)
+	return err
+}
+
+// GetRange writes length bytes of from starting at offset to out, or until the end of the file
+// when length is negative. Fewer bytes are written when the file ends first.
+func (s *Session) GetRange(from string, offset int64, length int64, out io.Writer, opts ...TransferOption) error {
+	if offset < 0 {
+		return fmt.Errorf("negative offset %d", offset)
+	}
+	t := newTransfer(from, newTransferOptions(opts))
+	defer t.finish()
+	if err := s.statTotal(t, uint64(offset), length); err != nil {
+		return err
+	}
+	_, err := s.get(from, uint64(offset), length, out, t)
+	return err
+}
+
+// statTotal sets the total size of a download of length bytes from offset for progress
+// reporting, which requires a Stat when length is negative
+func (s *Session) statTotal(t *transfer, offset uint64, length int64) error {
+	if t.progress == nil {
+		return nil
+	}
+	if length >= 0 {
+		t.total = uint64(length)
+		return nil
+	}
+	t.request()
+	attrs, err := s.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	if attrs.Size > offset {
+		t.total = attrs.Size - offset
+	}
+	return nil
+}
+
+// ResumeGet downloads remote to the local file localPath, continuing after any content already
+// in localPath from an earlier interrupted download. The local file must not be larger than
+// remote, and is checked to have the size of remote when complete.
+func (s *Session) ResumeGet(remote string, localPath string, opts ...TransferOption) error {
+	t := newTransfer(remote, newTransferOptions(opts))
+	defer t.finish()
+	t.request()
+	attrs, err := s.Stat(remote)
+	if err != nil {
+		return err
+	}
+	if attrs.Flags&SSH_FILEXFER_ATTR_SIZE == 0 {
+		return fmt.Errorf("%s: size unknown, can not resume", remote)
+	}
+	f, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(fi.Size())
+	if size > attrs.Size {
+		return fmt.Errorf("%s: local size %d is larger than remote size %d", localPath, size, attrs.Size)
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	t.offset, t.total = size, attrs.Size
+	n, err := s.get(remote, size, int64(attrs.Size-size), f, t)
+	if err != nil {
+		return err
+	}
+	if size+n != attrs.Size {
+		return fmt.Errorf("%s: downloaded %d of %d bytes", remote, size+n, attrs.Size)
+	}
+	return f.Close()
+}
+
+// get writes length bytes of from starting at offset to out, or until the end of the file when
+// length is negative, returning the number of bytes written
+func (s *Session) get(from string, offset uint64, length int64, out io.Writer, t *transfer) (uint64, error) {
 	id := s.nextSeq()
 	read := s.r.getChan(id)
 	defer s.r.delChan(id)
+	t.request()
 	handle, err := s.OpenReq(id, read, from)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer func() { _ = s.CloseReq(id, read, handle) }()
-	// how much to read at a time ?
-	//
-	// https://github.com/openssh/openssh-portable/blob/master/sftp-common.h#L29
-	// /* Maximum packet that we are willing to send/accept */
-	//    #define SFTP_MAX_MSG_LENGTH	(256 * 1024)
-	cont := true
-	offset := uint64(0)
-	len := uint32(255 * 1024)
-	for cont {
-		b, err := s.ReadReq(id, read, handle, offset, len)
-		if err != nil {
-			if err == io.EOF {
-				cont = false
-			} else {
-				return err
-			}
+	defer func() {
+		t.request()
+		_ = s.CloseReq(id, read, handle)
+	}()
+	written := uint64(0)
+	for length < 0 || written < uint64(length) {
+		n := s.readLength()
+		if length >= 0 && uint64(length)-written < uint64(n) {
+			n = uint32(uint64(length) - written)
+		}
+		if err := s.limit(t, int(n)); err != nil {
+			return written, err
+		}
+		t.request()
+		b, err := s.ReadReq(id, read, handle, offset+written, n)
+		if err == io.EOF {
+			break
 		}
-		_, err = out.Write(b)
 		if err != nil {
-			return err
+			return written, err
+		}
+		if _, err := out.Write(b); err != nil {
+			return written, err
 		}
-		offset += uint64(len)
+		// servers may return less than requested before the end of the file
+		written += uint64(len(b))
+		t.add(len(b))
 	}
+	return written, nil
+}
+
+// readLength is how much to request with one read, so that the DATA response fits within the
+// maximum packet size of the Session
+func (s *Session) readLength() uint32 {
+	if s.r.maxPacketSize <= dataOverhead {
+		return 1
+	}
+	return min(maxDataLength, s.r.maxPacketSize-dataOverhead)
+}
+
+// Remove deletes the file path
+func (s *Session) Remove(path string) error {
+	return s.request(&RemoveReq{Filename: path})
+}
+
+// Rename renames oldPath to newPath, failing if newPath exists
+func (s *Session) Rename(oldPath string, newPath string) error {
+	return s.request(&RenameReq{OldPath: oldPath, NewPath: newPath})
+}
 
+// Mkdir creates the directory path with the permissions perm
+func (s *Session) Mkdir(path string, perm fs.FileMode) error {
+	attrs := Attrs{Flags: SSH_FILEXFER_ATTR_PERMISSIONS, Permissions: FileMode(perm.Perm())}
+	return s.request(&MkdirReq{Path: path, Attrs: attrs})
+}
+
+// MkdirAll creates the directory dir and any missing parents with the permissions perm. It
+// succeeds when dir already exists as a directory.
+func (s *Session) MkdirAll(dir string, perm fs.FileMode) error {
+	attrs, err := s.Stat(dir)
+	if err == nil {
+		if !attrs.Permissions.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err := s.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := s.Mkdir(dir, perm); err != nil {
+		// another request may have created it meanwhile
+		if attrs, sErr := s.Stat(dir); sErr == nil && attrs.Permissions.IsDir() {
+			return nil
+		}
+		return err
+	}
 	return nil
 }
 
+// Rmdir removes the empty directory path
+func (s *Session) Rmdir(path string) error {
+	return s.request(&RmdirReq{Path: path})
+}
+
+// Setstat sets the attributes of path which are flagged in attrs
+func (s *Session) Setstat(path string, attrs Attrs) error {
+	return s.request(&SetstatReq{Path: path, Attrs: attrs})
+}
+
+// PosixRename renames oldPath to newPath, atomically replacing newPath if it exists, using the
+// posix-rename@openssh.com extension. It fails with errors.ErrUnsupported when the server does
+// not advertise the extension.
+func (s *Session) PosixRename(oldPath string, newPath string) error {
+	if !s.hasExtension(extPosixRename) {
+		return fmt.Errorf("%s: %w", extPosixRename, errors.ErrUnsupported)
+	}
+	buf := bytes.NewBuffer(nil)
+	_ = WriteString(buf, oldPath)
+	_ = WriteString(buf, newPath)
+	return s.request(&ExtendedReq{Request: extPosixRename, Data: buf.Bytes()})
+}
+
+// request sends a request answered with a StatusResp, setting its id
+func (s *Session) request(m request) error {
+	id := s.nextSeq()
+	read := s.r.getChan(id)
+	defer s.r.delChan(id)
+	m.setId(id)
+	if err := s.w.write(m); err != nil {
+		return err
+	}
+	return s.statusReq(read)
+}
+
+// Stat returns the attributes of path, following symbolic links
+func (s *Session) Stat(path string) (Attrs, error) {
+	id := s.nextSeq()
+	read := s.r.getChan(id)
+	defer s.r.delChan(id)
+	if err := s.w.write(&StatReq{Header: Header{Id: id}, Path: path}); err != nil {
+		return Attrs{}, err
+	}
+	msg, err := s.recv(read)
+	if err != nil {
+		return Attrs{}, err
+	}
+	switch msg := msg.(type) {
+	case *AttrsResp:
+		return msg.Attrs, nil
+	case *StatusResp:
+		return Attrs{}, statusError(msg)
+	default:
+		return Attrs{}, fmt.Errorf("unhandled message type %T", msg)
+	}
+}
+
 func (s *Session) ReadReq(id uint32, read chan Msg, handle string, offset uint64, len uint32) ([]byte, error) {
 	if err := s.w.write(&ReadReq{Header: Header{Id: id}, Handle: handle, Offset: offset, Len: len}); err != nil {
 		return nil, err
 	}
-	msg := <-read
+	msg, err := s.recv(read)
+	if err != nil {
+		return nil, err
+	}
 	switch msg := msg.(type) {
 	case *DataResp:
 		return msg.Data, nil
@@ -233,7 +605,7 @@ func (s *Session) ReadReq(id uint32, read chan Msg, handle string, offset uint64
 		if msg.ErrorCode == SSH_FX_OK {
 			return nil, io.EOF
 		} else {
-			return nil, fmt.Errorf("error: %s", msg.ErrorMessage)
+			return nil, statusError(msg)
 		}
 	default:
 		return nil, fmt.Errorf("unhandled message type %T", msg)
@@ -244,7 +616,10 @@ func (s *Session) CloseReq(id uint32, read chan Msg, handle string) error {
 	if err := s.w.write(&CloseReq{Header: Header{Id: id}, Handle: handle}); err != nil {
 		return err
 	}
-	msg := <-read
+	msg, err := s.recv(read)
+	if err != nil {
+		return err
+	}
 	switch msg := msg.(type) {
 	case *StatusResp:
 		if msg.ErrorCode != SSH_FX_OK {
@@ -260,7 +635,10 @@ func (s *Session) OpenReq(id uint32, read chan Msg, path string) (string, error)
 	if err := s.w.write(&OpenReq{Header: Header{Id: id}, Filename: path, Pflags: SSH_FXF_READ}); err != nil {
 		return "", err
 	}
-	msg := <-read
+	msg, err := s.recv(read)
+	if err != nil {
+		return "", err
+	}
 	var handle string
 	handleResp, statusResp, err := s.handleOrStatusResp(msg)
 	switch true {
@@ -269,7 +647,7 @@ func (s *Session) OpenReq(id uint32, read chan Msg, path string) (string, error)
 	case handleResp != nil:
 		handle = handleResp.Handle
 	case statusResp != nil:
-		return "", fmt.Errorf("error: %s", statusResp.ErrorMessage)
+		return "", statusError(statusResp)
 	}
 	return handle, nil
 }
@@ -278,7 +656,10 @@ func (s *Session) readDirReq(id uint32, read chan Msg, handle string) (*NameResp
 	if err := s.w.write(&ReadDirReq{Header: Header{Id: id}, Handle: handle}); err != nil {
 		return nil, nil, err
 	}
-	msg := <-read
+	msg, err := s.recv(read)
+	if err != nil {
+		return nil, nil, err
+	}
 	nameResp, statusResp, err := s.nameOrStatusResp(msg)
 	switch true {
 	case err != nil:
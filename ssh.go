@@ -1,30 +1,478 @@
 package usftp
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
 	"os"
+	"strconv"
+	"time"
 )
 
-func Dial(user string, host string, port int, privateKeyPath string, hostKeyCallback ssh.HostKeyCallback) (*ssh.Client, error) {
-	b, err := os.ReadFile(privateKeyPath)
-	signer, err := ssh.ParsePrivateKey(b)
+// keepaliveRequest is the global request OpenSSH clients send as a keepalive
+const keepaliveRequest = "keepalive@openssh.com"
+
+type (
+	// DialOption configures Dial
+	DialOption func(*dialOptions)
+
+	dialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+
+	// PassphraseCallback returns the passphrase for an encrypted private key. name is the path of
+	// the identity file, or empty for a key given with WithPrivateKey or WithCertificate.
+	PassphraseCallback func(name string) ([]byte, error)
+
+	dialOptions struct {
+		agent           bool
+		identities      []identity
+		passphrase      PassphraseCallback
+		knownHosts      []string
+		noKnownHosts    bool
+		fingerprints    []string
+		trustOnFirstUse string
+		insecure        bool
+		auths           []ssh.AuthMethod
+		timeout         time.Duration
+		ciphers         []string
+		keyExchanges    []string
+		macs            []string
+		clientVersion   string
+		banner          ssh.BannerCallback
+		keepalive       time.Duration
+		keepaliveMax    int
+		jumps           []jumpHost
+		configFiles     []string
+		sessionOpts     []SessionOption
+		retries         int
+		minBackoff      time.Duration
+		maxBackoff      time.Duration
+		// ctx stops dialing and the handshake when done, see Connect
+		ctx context.Context
+	}
+
+	// jumpHost is an intermediate host connected through, as with the ProxyJump option of OpenSSH
+	jumpHost struct {
+		user string
+		host string
+		port int
+		opts []DialOption
+	}
+
+	// identity is a private key from a file or memory, with an optional certificate
+	identity struct {
+		path     string
+		key      []byte
+		certPath string
+		cert     []byte
+	}
+)
+
+// withContext stops dialing when ctx is done, it is set by Connect
+func withContext(ctx context.Context) DialOption {
+	return func(o *dialOptions) {
+		o.ctx = ctx
+	}
+}
+
+// WithAgent authenticates with each identity held by the ssh-agent listening on SSH_AUTH_SOCK.
+// They are tried after any private key files, and the private key path given to Dial may be
+// left empty to use only the agent.
+func WithAgent() DialOption {
+	return func(o *dialOptions) {
+		o.agent = true
+	}
+}
+
+// WithIdentityFile adds a private key file, tried in order after the private key path given to
+// Dial. As with OpenSSH, a certificate in path + "-cert.pub" is used when present.
+func WithIdentityFile(path string) DialOption {
+	return func(o *dialOptions) {
+		o.identities = append(o.identities, identity{path: path})
+	}
+}
+
+// WithCertificateFile adds a private key file along with the OpenSSH certificate signed for it
+func WithCertificateFile(path string, certPath string) DialOption {
+	return func(o *dialOptions) {
+		o.identities = append(o.identities, identity{path: path, certPath: certPath})
+	}
+}
+
+// WithPrivateKey adds a PEM encoded private key held in memory
+func WithPrivateKey(key []byte) DialOption {
+	return func(o *dialOptions) {
+		o.identities = append(o.identities, identity{key: key})
+	}
+}
+
+// WithCertificate adds a PEM encoded private key along with the OpenSSH certificate, in
+// authorized_keys format, signed for it
+func WithCertificate(key []byte, cert []byte) DialOption {
+	return func(o *dialOptions) {
+		o.identities = append(o.identities, identity{key: key, cert: cert})
+	}
+}
+
+// WithPassphrase is called for each encrypted private key
+func WithPassphrase(callback PassphraseCallback) DialOption {
+	return func(o *dialOptions) {
+		o.passphrase = callback
+	}
+}
+
+// WithPassword authenticates with password, tried after public keys
+func WithPassword(password string) DialOption {
+	return func(o *dialOptions) {
+		o.auths = append(o.auths, ssh.Password(password))
+	}
+}
+
+// WithPasswordCallback authenticates with the password returned by callback, tried after public
+// keys
+func WithPasswordCallback(callback func() (string, error)) DialOption {
+	return func(o *dialOptions) {
+		o.auths = append(o.auths, ssh.PasswordCallback(callback))
+	}
+}
+
+// WithKeyboardInteractive authenticates by answering the questions asked by the server with
+// challenge, tried after public keys
+func WithKeyboardInteractive(challenge ssh.KeyboardInteractiveChallenge) DialOption {
+	return func(o *dialOptions) {
+		o.auths = append(o.auths, ssh.KeyboardInteractive(challenge))
+	}
+}
+
+// WithTimeout limits the time taken to connect and complete the SSH handshake, including
+// authentication
+func WithTimeout(timeout time.Duration) DialOption {
+	return func(o *dialOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithCiphers sets the allowed ciphers in order of preference, see ssh.Config
+func WithCiphers(ciphers ...string) DialOption {
+	return func(o *dialOptions) {
+		o.ciphers = ciphers
+	}
+}
+
+// WithKeyExchanges sets the allowed key exchange algorithms in order of preference, see
+// ssh.Config
+func WithKeyExchanges(keyExchanges ...string) DialOption {
+	return func(o *dialOptions) {
+		o.keyExchanges = keyExchanges
+	}
+}
+
+// WithMACs sets the allowed MAC algorithms in order of preference, see ssh.Config
+func WithMACs(macs ...string) DialOption {
+	return func(o *dialOptions) {
+		o.macs = macs
+	}
+}
+
+// WithClientVersion sets the identification string sent to the server, which must start with
+// "SSH-2.0-"
+func WithClientVersion(version string) DialOption {
+	return func(o *dialOptions) {
+		o.clientVersion = version
+	}
+}
+
+// WithBannerCallback is called with the banner sent by the server before authentication
+func WithBannerCallback(callback ssh.BannerCallback) DialOption {
+	return func(o *dialOptions) {
+		o.banner = callback
+	}
+}
+
+// WithKeepalive sends a keepalive request every interval, closing the client when maxMissed
+// consecutive requests are not answered within the interval. Sessions on the client then fail
+// rather than waiting on a connection which has gone away.
+func WithKeepalive(interval time.Duration, maxMissed int) DialOption {
+	return func(o *dialOptions) {
+		o.keepalive = interval
+		o.keepaliveMax = maxMissed
+	}
+}
+
+// WithJumpHost connects through host, authenticating as user as configured by opts, in the same
+// way as the ProxyJump option of OpenSSH. Jump hosts are connected through in the order given,
+// and are closed when the client returned by Dial is closed. Jump hosts in opts are ignored.
+func WithJumpHost(user string, host string, port int, opts ...DialOption) DialOption {
+	return func(o *dialOptions) {
+		o.jumps = append(o.jumps, jumpHost{user: user, host: host, port: port, opts: opts})
+	}
+}
+
+// Dial connects to host and authenticates as user with the private key at privateKeyPath and
+// any identities or other auth methods given as options. The host key is checked with
+// hostKeyCallback, or when nil as configured by the options, by default against
+// ~/.ssh/known_hosts.
+func Dial(user string, host string, port int, privateKeyPath string, hostKeyCallback ssh.HostKeyCallback, opts ...DialOption) (*ssh.Client, error) {
+	o := newDialOptions(privateKeyPath, opts)
+	ctx := o.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var dial dialFunc
+	var jumps []*ssh.Client
+	closeJumps := func() {
+		for i := len(jumps) - 1; i >= 0; i-- {
+			_ = jumps[i].Close()
+		}
+	}
+	for _, j := range o.jumps {
+		jo := newDialOptions("", j.opts)
+		jc, err := jo.connect(ctx, j.user, hostPort(j.host, j.port), nil, dial)
+		if err != nil {
+			closeJumps()
+			return nil, fmt.Errorf("jump host %s: %w", j.host, err)
+		}
+		jumps = append(jumps, jc)
+		dial = jc.DialContext
+	}
+	client, err := o.connect(ctx, user, hostPort(host, port), hostKeyCallback, dial)
 	if err != nil {
+		closeJumps()
 		return nil, err
 	}
-	auths := []ssh.AuthMethod{
-		ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
-			return []ssh.Signer{signer}, nil
-		}),
+	if len(jumps) > 0 {
+		go func() {
+			_ = client.Wait()
+			closeJumps()
+		}()
+	}
+	return client, nil
+}
+
+func newDialOptions(privateKeyPath string, opts []DialOption) *dialOptions {
+	o := &dialOptions{}
+	if privateKeyPath != "" {
+		o.identities = append(o.identities, identity{path: privateKeyPath})
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func hostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// connect dials addr, over TCP when dial is nil, and authenticates as user. Dialing and the
+// handshake are abandoned when ctx is done.
+func (o *dialOptions) connect(ctx context.Context, user string, addr string, hostKeyCallback ssh.HostKeyCallback, dial dialFunc) (*ssh.Client, error) {
+	var signers []ssh.Signer
+	for _, id := range o.identities {
+		s, err := id.signers(o.passphrase)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, s...)
+	}
+	if o.agent {
+		conn, err := dialAgent()
+		if err != nil {
+			return nil, err
+		}
+		// the agent signs during the handshake, so remains open until connected
+		defer func() { _ = conn.Close() }()
+		agentSigners, err := agent.NewClient(conn).Signers()
+		if err != nil {
+			return nil, fmt.Errorf("ssh-agent: %w", err)
+		}
+		signers = append(signers, agentSigners...)
+	}
+	var auths []ssh.AuthMethod
+	if len(signers) > 0 {
+		auths = append(auths, ssh.PublicKeys(signers...))
+	}
+	auths = append(auths, o.auths...)
+	var algorithms []string
+	if hostKeyCallback == nil {
+		var err error
+		if hostKeyCallback, algorithms, err = o.hostKeyCallback(addr); err != nil {
+			return nil, err
+		}
 	}
 	config := ssh.ClientConfig{
-		User:            user,
-		Auth:            auths,
-		HostKeyCallback: hostKeyCallback,
+		User:              user,
+		Auth:              auths,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: algorithms,
+		BannerCallback:    o.banner,
+		ClientVersion:     o.clientVersion,
+		Timeout:           o.timeout,
+	}
+	config.Ciphers = o.ciphers
+	config.KeyExchanges = o.keyExchanges
+	config.MACs = o.macs
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: o.timeout}).DialContext
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newClient(ctx, conn, addr, &config)
+	if err != nil {
+		return nil, err
 	}
-	if config.HostKeyCallback == nil {
-		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	if o.keepalive > 0 {
+		go keepalive(client, o.keepalive, o.keepaliveMax)
+	}
+	return client, nil
+}
+
+// newClient runs the SSH handshake on conn, closing conn if it does not complete within
+// config.Timeout or before ctx is done. Connections through a jump host do not support
+// deadlines.
+func newClient(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var timer *time.Timer
+	if config.Timeout > 0 {
+		timer = time.AfterFunc(config.Timeout, func() { _ = conn.Close() })
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	expired := timer != nil && !timer.Stop()
+	canceled := !stop()
+	if err == nil && (expired || canceled) {
+		_ = c.Close()
+	}
+	switch {
+	case canceled:
+		_ = conn.Close()
+		return nil, fmt.Errorf("ssh handshake: %w", context.Cause(ctx))
+	case expired:
+		_ = conn.Close()
+		return nil, fmt.Errorf("ssh handshake: %w", os.ErrDeadlineExceeded)
+	case err != nil:
+		_ = conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// keepalive sends a keepalive request every interval until the client is closed, closing it
+// when maxMissed consecutive requests go unanswered or a request fails
+func keepalive(c *ssh.Client, interval time.Duration, maxMissed int) {
+	done := make(chan struct{})
+	go func() {
+		_ = c.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		reply := make(chan error, 1)
+		go func() {
+			// servers not implementing the request reply with a failure, which is still an answer
+			_, _, err := c.SendRequest(keepaliveRequest, true, nil)
+			reply <- err
+		}()
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err != nil {
+				_ = c.Close()
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= maxMissed {
+				_ = c.Close()
+				return
+			}
+		}
+	}
+}
+
+// signers loads the private key, decrypting it with passphrase when required. When there is a
+// certificate the certificate signer is returned before the plain key.
+func (id identity) signers(passphrase PassphraseCallback) ([]ssh.Signer, error) {
+	name := id.path
+	if name == "" {
+		name = "private key"
+	}
+	key := id.key
+	if id.path != "" {
+		b, err := os.ReadFile(id.path)
+		if err != nil {
+			return nil, fmt.Errorf("identity file: %w", err)
+		}
+		key = b
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		pass, err := passphrase(id.path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, pass)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	cert := id.cert
+	certPath := id.certPath
+	if certPath == "" && id.path != "" {
+		if _, err := os.Stat(id.path + "-cert.pub"); err == nil {
+			certPath = id.path + "-cert.pub"
+		}
+	}
+	if certPath != "" {
+		if cert, err = os.ReadFile(certPath); err != nil {
+			return nil, fmt.Errorf("certificate file: %w", err)
+		}
+	}
+	if cert == nil {
+		return []ssh.Signer{signer}, nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(cert)
+	if err != nil {
+		return nil, fmt.Errorf("%s certificate: %w", name, err)
+	}
+	c, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s certificate: not a certificate", name)
+	}
+	certSigner, err := ssh.NewCertSigner(c, signer)
+	if err != nil {
+		return nil, fmt.Errorf("%s certificate: %w", name, err)
+	}
+	return []ssh.Signer{certSigner, signer}, nil
+}
+
+func dialAgent() (net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("ssh-agent: SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("ssh-agent: %w", err)
 	}
-	addr := fmt.Sprintf("%s:%d", host, port)
-	return ssh.Dial("tcp", addr, &config)
+	return conn, nil
 }
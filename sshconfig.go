@@ -0,0 +1,407 @@
+package usftp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// systemConfigFile is read after the user config file, as with ssh(1)
+	systemConfigFile = "/etc/ssh/ssh_config"
+	// maxIncludeDepth limits nested Include directives
+	maxIncludeDepth = 16
+	// maxJumpDepth limits jump hosts reached through the ProxyJump of other jump hosts
+	maxJumpDepth = 8
+	// noKnownHostsFiles is the UserKnownHostsFile value disabling known hosts files
+	noKnownHostsFiles = "none"
+)
+
+// HostConfig is the configuration for a host alias resolved from OpenSSH client config files,
+// see ssh_config(5). Settings not given in the files have the ssh(1) defaults.
+type HostConfig struct {
+	Alias         string
+	HostName      string
+	User          string
+	Port          int
+	IdentityFiles []string
+	ProxyJump     []string
+	// UserKnownHostsFiles is ["none"] when known hosts files are disabled, so that no host
+	// key is known
+	UserKnownHostsFiles []string
+}
+
+// WithConfigFiles sets the OpenSSH client config files read by DialHost, instead of
+// ~/.ssh/config and /etc/ssh/ssh_config
+func WithConfigFiles(files ...string) DialOption {
+	return func(o *dialOptions) {
+		o.configFiles = append(o.configFiles, files...)
+	}
+}
+
+// DialHost connects to the host alias using the HostName, User, Port, IdentityFile, ProxyJump
+// and UserKnownHostsFile settings from OpenSSH client config files. Identity and known hosts
+// files which do not exist are skipped, as with ssh(1). Jump hosts are resolved from the same
+// files. opts are applied after the config to each host connected to, so may add to it, for
+// example with WithAgent or WithPassphrase.
+func DialHost(alias string, opts ...DialOption) (*ssh.Client, error) {
+	files := newDialOptions("", opts).configFiles
+	hc, err := ResolveHost(alias, files...)
+	if err != nil {
+		return nil, err
+	}
+	dialOpts, err := hc.jumpOptions(files, opts, 0)
+	if err != nil {
+		return nil, err
+	}
+	dialOpts = append(dialOpts, hc.dialOptions()...)
+	return Dial(hc.User, hc.HostName, hc.Port, "", nil, append(dialOpts, opts...)...)
+}
+
+// jumpOptions returns a WithJumpHost option for each ProxyJump host of hc, resolving their
+// HostName, User, Port and IdentityFile from files. As with ssh(1), the first jump host is
+// itself reached through its own ProxyJump setting.
+func (hc HostConfig) jumpOptions(files []string, opts []DialOption, depth int) ([]DialOption, error) {
+	if depth > maxJumpDepth {
+		return nil, fmt.Errorf("too many nested jump hosts for %s", hc.Alias)
+	}
+	var dialOpts []DialOption
+	for i, jump := range hc.ProxyJump {
+		u, h, p, err := parseJump(jump)
+		if err != nil {
+			return nil, err
+		}
+		jc, err := ResolveHost(h, files...)
+		if err != nil {
+			return nil, err
+		}
+		if u != "" {
+			jc.User = u
+		}
+		if p != 0 {
+			jc.Port = p
+		}
+		if i == 0 {
+			chain, err := jc.jumpOptions(files, opts, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			dialOpts = append(dialOpts, chain...)
+		}
+		dialOpts = append(dialOpts, WithJumpHost(jc.User, jc.HostName, jc.Port, append(jc.dialOptions(), opts...)...))
+	}
+	return dialOpts, nil
+}
+
+// dialOptions returns options for the identity and known hosts files which exist
+func (hc HostConfig) dialOptions() []DialOption {
+	var opts []DialOption
+	for _, f := range hc.IdentityFiles {
+		if _, err := os.Stat(f); err == nil {
+			opts = append(opts, WithIdentityFile(f))
+		}
+	}
+	if len(hc.UserKnownHostsFiles) == 1 && hc.UserKnownHostsFiles[0] == noKnownHostsFiles {
+		return append(opts, withoutKnownHostsFiles())
+	}
+	var knownHosts []string
+	for _, f := range hc.UserKnownHostsFiles {
+		if _, err := os.Stat(f); err == nil {
+			knownHosts = append(knownHosts, f)
+		}
+	}
+	if len(knownHosts) == 0 {
+		// report the missing file rather than falling back to the default
+		knownHosts = hc.UserKnownHostsFiles
+	}
+	return append(opts, WithKnownHostsFiles(knownHosts...))
+}
+
+// ResolveHost reads the configuration for alias from files, by default ~/.ssh/config and
+// /etc/ssh/ssh_config, skipping them when missing. As with ssh(1) the first value obtained for
+// a setting is used, except IdentityFile which accumulates. Match blocks are not supported and
+// are skipped.
+func ResolveHost(alias string, files ...string) (HostConfig, error) {
+	home, _ := os.UserHomeDir()
+	hc := HostConfig{Alias: alias}
+	p := configParser{alias: alias, home: home, config: &hc, set: map[string]bool{}}
+	if len(files) == 0 {
+		for _, f := range []string{filepath.Join(home, ".ssh", "config"), systemConfigFile} {
+			if err := p.parseFile(f, 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return hc, err
+			}
+		}
+	} else {
+		for _, f := range files {
+			if err := p.parseFile(f, 0); err != nil {
+				return hc, err
+			}
+		}
+	}
+
+	local := localUser()
+	if hc.HostName == "" {
+		hc.HostName = alias
+	}
+	hc.HostName = expandTokens(hc.HostName, map[byte]string{'h': alias})
+	if hc.User == "" {
+		hc.User = local
+	}
+	if hc.Port == 0 {
+		hc.Port = 22
+	}
+	if len(hc.IdentityFiles) == 0 {
+		for _, name := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+			hc.IdentityFiles = append(hc.IdentityFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+	if len(hc.UserKnownHostsFiles) == 0 {
+		hc.UserKnownHostsFiles = []string{filepath.Join(home, ".ssh", "known_hosts"), filepath.Join(home, ".ssh", "known_hosts2")}
+	}
+	tokens := map[byte]string{'h': hc.HostName, 'p': strconv.Itoa(hc.Port), 'r': hc.User, 'u': local, 'd': home}
+	for i, f := range hc.IdentityFiles {
+		hc.IdentityFiles[i] = expandPath(expandTokens(f, tokens), home)
+	}
+	for i, f := range hc.UserKnownHostsFiles {
+		if f != noKnownHostsFiles {
+			hc.UserKnownHostsFiles[i] = expandPath(expandTokens(f, tokens), home)
+		}
+	}
+	return hc, nil
+}
+
+type configParser struct {
+	alias  string
+	home   string
+	config *HostConfig
+	set    map[string]bool
+}
+
+// parseFile applies the settings in file for the alias. Relative Include paths are resolved
+// against ~/.ssh, or /etc/ssh for the system config file.
+func (p *configParser) parseFile(file string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("ssh config %s: too many nested includes", file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("ssh config: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+	dir := filepath.Join(p.home, ".ssh")
+	if strings.HasPrefix(file, filepath.Dir(systemConfigFile)+"/") {
+		dir = filepath.Dir(systemConfigFile)
+	}
+
+	active := true
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		keyword, args, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("ssh config %s:%d: %w", file, n, err)
+		}
+		switch keyword {
+		case "":
+			continue
+		case "host":
+			active = matchHost(args, p.alias)
+			continue
+		case "match":
+			active = false
+			continue
+		}
+		if !active {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("ssh config %s:%d: missing argument for %s", file, n, keyword)
+		}
+		if keyword == "include" {
+			for _, pattern := range args {
+				pattern = expandPath(pattern, p.home)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(dir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("ssh config %s:%d: %w", file, n, err)
+				}
+				for _, m := range matches {
+					if err := p.parseFile(m, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		}
+		if err := p.apply(keyword, args); err != nil {
+			return fmt.Errorf("ssh config %s:%d: %w", file, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// apply sets keyword unless already set, other than identityfile which accumulates
+func (p *configParser) apply(keyword string, args []string) error {
+	if keyword == "identityfile" {
+		p.config.IdentityFiles = append(p.config.IdentityFiles, args[0])
+		return nil
+	}
+	if p.set[keyword] {
+		return nil
+	}
+	switch keyword {
+	case "hostname":
+		p.config.HostName = args[0]
+	case "user":
+		p.config.User = args[0]
+	case "port":
+		port, err := strconv.Atoi(args[0])
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %q", args[0])
+		}
+		p.config.Port = port
+	case "proxyjump":
+		if args[0] != "none" {
+			p.config.ProxyJump = strings.Split(args[0], ",")
+		}
+	case "userknownhostsfile":
+		if args[0] == noKnownHostsFiles {
+			p.config.UserKnownHostsFiles = []string{noKnownHostsFiles}
+		} else {
+			p.config.UserKnownHostsFiles = args
+		}
+	default:
+		// not used by usftp
+		return nil
+	}
+	p.set[keyword] = true
+	return nil
+}
+
+// splitConfigLine returns the lower case keyword and arguments of a line, with an empty keyword
+// for blank lines and comments. Arguments may be quoted, and the keyword may be followed by "=".
+func splitConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+	var args []string
+	for rest != "" {
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, errors.New("unterminated quote")
+			}
+			args = append(args, rest[1:end+1])
+			rest = strings.TrimLeft(rest[end+2:], " \t")
+			continue
+		}
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		if rest[0] == '#' {
+			break
+		}
+		args = append(args, rest[:end])
+		rest = strings.TrimLeft(rest[end:], " \t")
+	}
+	return keyword, args, nil
+}
+
+// matchHost reports whether alias matches one of the patterns and none of the negated patterns
+func matchHost(patterns []string, alias string) bool {
+	alias = strings.ToLower(alias)
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "!"))
+		ok, err := path.Match(pattern, alias)
+		if err != nil || !ok {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// parseJump splits a ProxyJump entry of the form [user@]host[:port]
+func parseJump(jump string) (string, string, int, error) {
+	var u string
+	if i := strings.LastIndexByte(jump, '@'); i >= 0 {
+		u, jump = jump[:i], jump[i+1:]
+	}
+	host, port := jump, 0
+	if i := strings.LastIndexByte(jump, ':'); i >= 0 && !strings.HasSuffix(jump, "]") {
+		var err error
+		if port, err = strconv.Atoi(jump[i+1:]); err != nil {
+			return "", "", 0, fmt.Errorf("invalid jump host %q", jump)
+		}
+		host = jump[:i]
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return "", "", 0, fmt.Errorf("invalid jump host %q", jump)
+	}
+	return u, host, port, nil
+}
+
+// expandTokens replaces the % tokens of ssh_config(5) given in tokens, and %%
+func expandTokens(s string, tokens map[byte]string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if s[i] == '%' {
+			b.WriteByte('%')
+		} else if v, ok := tokens[s[i]]; ok {
+			b.WriteString(v)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// expandPath replaces a leading ~ with home
+func expandPath(p string, home string) string {
+	if p == "~" {
+		return home
+	}
+	if strings.HasPrefix(p, "~/") {
+		return filepath.Join(home, p[2:])
+	}
+	return p
+}
+
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,41 @@
+package usftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// StatusError is a StatusResp reporting that a request failed. It matches fs.ErrNotExist,
+// fs.ErrPermission, errors.ErrUnsupported and io.EOF with errors.Is according to Code.
+type StatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("sftp: status %d", e.Code)
+	}
+	return fmt.Sprintf("sftp: %s", e.Message)
+}
+
+func (e *StatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.Code == SSH_FX_NO_SUCH_FILE
+	case fs.ErrPermission:
+		return e.Code == SSH_FX_PERMISSION_DENIED
+	case errors.ErrUnsupported:
+		return e.Code == SSH_FX_OP_UNSUPPORTED
+	case io.EOF:
+		return e.Code == SSH_FX_EOF
+	}
+	return false
+}
+
+// statusError returns msg as an error, for responses where SSH_FX_OK is not expected
+func statusError(msg *StatusResp) error {
+	return &StatusError{Code: msg.ErrorCode, Message: msg.ErrorMessage}
+}
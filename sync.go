@@ -0,0 +1,412 @@
+package usftp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+type (
+	// SyncAction is a change made to the destination of a sync
+	SyncAction int
+
+	// SyncOp is one change in a SyncPlan
+	SyncOp struct {
+		Action SyncAction
+		// Path is slash separated and relative to the directories being synced, with "." for the
+		// destination directory itself
+		Path string
+		// Dir is true when Path is a directory
+		Dir bool
+		// Size is the number of bytes to copy
+		Size uint64
+	}
+
+	// SyncPlan lists the changes made by a sync, or to be made with WithDryRun, in the order they
+	// are applied. Deletions come first, deepest first, then directories are created and files
+	// copied.
+	SyncPlan []SyncOp
+
+	// syncTree holds the attributes of the directories and regular files of a tree by relative
+	// path
+	syncTree map[string]Attrs
+
+	// syncer applies the operations of a plan to the destination of a sync
+	syncer struct {
+		remove   func(name string, dir bool) error
+		mkdir    func(name string) error
+		copy     func(name string, attrs Attrs, o transferOptions) error
+		setAttrs func(name string, attrs Attrs) error
+		// same compares the content of a file present on both sides
+		same func(name string) (bool, error)
+	}
+)
+
+const (
+	// SyncCopy copies a file which is missing or changed
+	SyncCopy SyncAction = iota
+	// SyncMkdir creates a missing directory
+	SyncMkdir
+	// SyncDelete deletes a file or directory which is not in the source, see WithDelete
+	SyncDelete
+)
+
+func (a SyncAction) String() string {
+	switch a {
+	case SyncCopy:
+		return "copy"
+	case SyncMkdir:
+		return "mkdir"
+	case SyncDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("SyncAction(%d)", int(a))
+	}
+}
+
+// Bytes returns the number of bytes copied by the plan
+func (p SyncPlan) Bytes() uint64 {
+	var n uint64
+	for _, op := range p {
+		n += op.Size
+	}
+	return n
+}
+
+// WithDelete makes a sync delete files and directories from the destination which are not in the
+// source. Excluded paths are not deleted. Without it, a path which is a file on one side and a
+// directory on the other fails the sync.
+func WithDelete() TransferOption {
+	return func(o *transferOptions) {
+		o.delete = true
+	}
+}
+
+// WithDryRun makes a sync return its plan without changing anything
+func WithDryRun() TransferOption {
+	return func(o *transferOptions) {
+		o.dryRun = true
+	}
+}
+
+// WithChecksum makes a sync compare files of the same size by a SHA-256 checksum of their
+// content rather than by modification time. Both copies are read in full.
+func WithChecksum() TransferOption {
+	return func(o *transferOptions) {
+		o.checksum = true
+	}
+}
+
+// SyncDownload makes the local directory localPath a mirror of the directory remote, copying
+// files which are missing or differ in size or modification time, see WithChecksum, WithDelete
+// and WithDryRun. Files are copied as by DownloadDir, and the returned plan lists the changes
+// made. Entries which are neither regular files nor directories are ignored on both sides.
+func (s *Session) SyncDownload(remote string, localPath string, opts ...TransferOption) (SyncPlan, error) {
+	o := newTransferOptions(opts)
+	if err := o.checkPatterns(); err != nil {
+		return nil, err
+	}
+	src, err := s.remoteTree(remote, o)
+	if err != nil {
+		return nil, err
+	}
+	if src == nil {
+		return nil, &fs.PathError{Op: "sync", Path: remote, Err: fs.ErrNotExist}
+	}
+	dst, err := localTree(localPath, o)
+	if err != nil {
+		return nil, err
+	}
+	local := func(name string) string {
+		return filepath.Join(localPath, filepath.FromSlash(name))
+	}
+	return s.sync(src, dst, o, syncer{
+		remove: func(name string, dir bool) error {
+			return os.Remove(local(name))
+		},
+		mkdir: func(name string) error {
+			return os.MkdirAll(local(name), 0755)
+		},
+		copy: func(name string, attrs Attrs, o transferOptions) error {
+			from := path.Join(remote, name)
+			t := newTransfer(from, o)
+			defer t.finish()
+			return s.download(from, local(name), attrs, t)
+		},
+		setAttrs: func(name string, attrs Attrs) error {
+			return setLocalAttrs(local(name), attrs)
+		},
+		same: func(name string) (bool, error) {
+			return s.sameContent(path.Join(remote, name), local(name))
+		},
+	})
+}
+
+// SyncUpload makes the directory remote a mirror of the local directory localPath, copying
+// files which are missing or differ in size or modification time, see WithChecksum, WithDelete
+// and WithDryRun. Files are copied as by UploadDir, and the returned plan lists the changes made.
+// Entries which are neither regular files nor directories are ignored on both sides.
+func (s *Session) SyncUpload(localPath string, remote string, opts ...TransferOption) (SyncPlan, error) {
+	o := newTransferOptions(opts)
+	if err := o.checkPatterns(); err != nil {
+		return nil, err
+	}
+	src, err := localTree(localPath, o)
+	if err != nil {
+		return nil, err
+	}
+	if src == nil {
+		return nil, &fs.PathError{Op: "sync", Path: localPath, Err: fs.ErrNotExist}
+	}
+	dst, err := s.remoteTree(remote, o)
+	if err != nil {
+		return nil, err
+	}
+	local := func(name string) string {
+		return filepath.Join(localPath, filepath.FromSlash(name))
+	}
+	return s.sync(src, dst, o, syncer{
+		remove: func(name string, dir bool) error {
+			if dir {
+				return s.Rmdir(path.Join(remote, name))
+			}
+			return s.Remove(path.Join(remote, name))
+		},
+		mkdir: func(name string) error {
+			return s.MkdirAll(path.Join(remote, name), 0755)
+		},
+		copy: func(name string, attrs Attrs, o transferOptions) error {
+			to := path.Join(remote, name)
+			attrs.Flags &^= SSH_FILEXFER_ATTR_SIZE
+			return s.uploadFile(local(name), to, attrs, newTransfer(to, o))
+		},
+		setAttrs: func(name string, attrs Attrs) error {
+			attrs.Flags &^= SSH_FILEXFER_ATTR_SIZE
+			return s.Setstat(path.Join(remote, name), attrs)
+		},
+		same: func(name string) (bool, error) {
+			return s.sameContent(path.Join(remote, name), local(name))
+		},
+	})
+}
+
+// sync plans the changes making dst a mirror of src and, unless a dry run, applies them with x
+func (s *Session) sync(src syncTree, dst syncTree, o transferOptions, x syncer) (SyncPlan, error) {
+	plan, err := planSync(src, dst, o, x.same)
+	if err != nil || o.dryRun {
+		return plan, err
+	}
+	o.shared = &sync.Mutex{}
+	eg, ctx := s.workers(o)
+	for _, op := range plan {
+		switch op.Action {
+		case SyncDelete:
+			err = x.remove(op.Path, op.Dir)
+		case SyncMkdir:
+			err = x.mkdir(op.Path)
+		case SyncCopy:
+			attrs := src[op.Path]
+			eg.Go(func() error {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return x.copy(op.Path, attrs, o)
+			})
+		}
+		if err != nil {
+			_ = eg.Wait()
+			return plan, err
+		}
+	}
+	if err := eg.Wait(); err != nil {
+		return plan, err
+	}
+	// set the attributes of every directory, deepest first, as their contents may have changed
+	names := src.sorted()
+	for i := len(names) - 1; i >= 0; i-- {
+		if attrs := src[names[i]]; attrs.Permissions.IsDir() {
+			if err := x.setAttrs(names[i], attrs); err != nil {
+				return plan, err
+			}
+		}
+	}
+	return plan, nil
+}
+
+// planSync returns the changes making dst a mirror of src, comparing files of the same size
+// with same when checksums are requested
+func planSync(src syncTree, dst syncTree, o transferOptions, same func(name string) (bool, error)) (SyncPlan, error) {
+	var plan SyncPlan
+	names := dst.sorted()
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		d := dst[name]
+		a, ok := src[name]
+		if ok && a.Permissions.IsDir() == d.Permissions.IsDir() {
+			continue
+		}
+		if ok && !o.delete {
+			return nil, &fs.PathError{Op: "sync", Path: name, Err: errors.New("file and directory conflict, see WithDelete")}
+		}
+		if o.delete {
+			plan = append(plan, SyncOp{Action: SyncDelete, Path: name, Dir: d.Permissions.IsDir()})
+		}
+	}
+	for _, name := range src.sorted() {
+		a := src[name]
+		d, ok := dst[name]
+		ok = ok && a.Permissions.IsDir() == d.Permissions.IsDir()
+		if a.Permissions.IsDir() {
+			if !ok {
+				plan = append(plan, SyncOp{Action: SyncMkdir, Path: name, Dir: true})
+			}
+			continue
+		}
+		if ok {
+			changed, err := syncChanged(name, a, d, o, same)
+			if err != nil {
+				return nil, err
+			}
+			if !changed {
+				continue
+			}
+		}
+		plan = append(plan, SyncOp{Action: SyncCopy, Path: name, Size: a.Size})
+	}
+	return plan, nil
+}
+
+// syncChanged reports whether the file name with the source attributes a and destination
+// attributes d needs copying
+func syncChanged(name string, a Attrs, d Attrs, o transferOptions, same func(name string) (bool, error)) (bool, error) {
+	if a.Flags&d.Flags&SSH_FILEXFER_ATTR_SIZE == 0 || a.Size != d.Size {
+		return true, nil
+	}
+	if o.checksum {
+		ok, err := same(name)
+		return !ok, err
+	}
+	return a.Flags&d.Flags&SSH_FILEXFER_ATTR_ACMODTIME == 0 || a.Mtime != d.Mtime, nil
+}
+
+// sorted returns the paths of the tree with each directory before its contents
+func (t syncTree) sorted() []string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == "." || names[j] == "." {
+			return names[i] == "."
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// remoteTree lists the directory remote, or returns nil when it does not exist
+func (s *Session) remoteTree(remote string, o transferOptions) (syncTree, error) {
+	attrs, err := s.Stat(remote)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !attrs.Permissions.IsDir() {
+		return nil, &fs.PathError{Op: "sync", Path: remote, Err: errors.New("not a directory")}
+	}
+	files, err := s.Find(remote)
+	if err != nil {
+		return nil, err
+	}
+	tree := syncTree{".": attrs}
+	var visit func(files []*NameRespFile, rel string) error
+	visit = func(files []*NameRespFile, rel string) error {
+		for _, file := range files {
+			if file.Filename == "." || file.Filename == ".." {
+				continue
+			}
+			if err := checkName(file); err != nil {
+				return err
+			}
+			name := path.Join(rel, file.Filename)
+			dir := file.Attrs.Permissions.IsDir()
+			if o.skip(name, dir) || !dir && !file.Attrs.Permissions.IsRegular() {
+				continue
+			}
+			tree[name] = file.Attrs
+			if err := visit(file.Children, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return tree, visit(files, "")
+}
+
+// localTree lists the local directory localPath, or returns nil when it does not exist
+func localTree(localPath string, o transferOptions) (syncTree, error) {
+	fi, err := os.Stat(localPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, &fs.PathError{Op: "sync", Path: localPath, Err: errors.New("not a directory")}
+	}
+	tree := syncTree{}
+	return tree, filepath.WalkDir(localPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name != "." && o.skip(name, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		tree[name] = FileInfoAttrs(fi)
+		return nil
+	})
+}
+
+// sameContent reports whether the file remote has the same SHA-256 checksum as the local file
+// localPath
+func (s *Session) sameContent(remote string, localPath string) (bool, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+	l, r := sha256.New(), sha256.New()
+	if _, err := io.Copy(l, f); err != nil {
+		return false, err
+	}
+	if err := s.Get(remote, r); err != nil {
+		return false, err
+	}
+	return bytes.Equal(l.Sum(nil), r.Sum(nil)), nil
+}
@@ -0,0 +1,105 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/usftptest"
+)
+
+// dropWriter drops the connections of srv after the first write
+type dropWriter struct {
+	bytes.Buffer
+	srv     *usftptest.Server
+	dropped bool
+}
+
+func (w *dropWriter) Write(b []byte) (int, error) {
+	n, err := w.Buffer.Write(b)
+	if !w.dropped {
+		w.dropped = true
+		w.srv.DropConnections()
+	}
+	return n, err
+}
+
+func clientHelper(t *testing.T, srv *usftptest.Server, opts ...usftp.DialOption) *usftp.Client {
+	opts = append(opts, usftp.WithBackoff(10*time.Millisecond, 50*time.Millisecond))
+	c, err := usftp.DialClient(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), srv.HostKeyCallback(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func Test_Session_ConnectionLost(t *testing.T) {
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", "a"))
+	s := srv.Session()
+	srv.DropConnections()
+	if _, err := s.Ls("/"); !errors.Is(err, usftp.ErrConnectionLost) {
+		t.Errorf("expected ErrConnectionLost, got %v", err)
+	}
+	_ = s.Close()
+	if _, err := s.Ls("/"); !errors.Is(err, usftp.ErrSessionClosed) {
+		t.Errorf("expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func Test_Client_Reconnect(t *testing.T) {
+	srv := usftptest.NewServer(t, usftptest.WithFile("/share/a", "a"))
+	c := clientHelper(t, srv)
+	if _, err := c.Ls("/share"); err != nil {
+		t.Fatal(err)
+	}
+	srv.DropConnections()
+	names, err := c.Ls("/share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Errorf("expected 3 names, got %d", len(names))
+	}
+	srv.DropConnections()
+	attrs, err := c.Stat("/share/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Size != 1 {
+		t.Errorf("expected size 1, got %d", attrs.Size)
+	}
+	srv.DropConnections()
+	if _, err := c.Find("/share"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Client_Get_Resume(t *testing.T) {
+	data := strings.Repeat("0123456789", 100*1024)
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", data))
+	c := clientHelper(t, srv)
+	w := &dropWriter{srv: srv}
+	if err := c.Get("/a", w); err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != data {
+		t.Errorf("expected %d bytes, got %d", len(data), w.Len())
+	}
+}
+
+func Test_Client_Retries(t *testing.T) {
+	srv := usftptest.NewServer(t)
+	c := clientHelper(t, srv, usftp.WithRetries(2))
+	_ = srv.Close()
+	if _, err := c.Ls("/"); err == nil {
+		t.Errorf("expected an error when the server is gone")
+	}
+	_ = c.Close()
+	if _, err := c.Ls("/"); !errors.Is(err, usftp.ErrSessionClosed) {
+		t.Errorf("expected ErrSessionClosed, got %v", err)
+	}
+}
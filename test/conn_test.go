@@ -0,0 +1,166 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/server"
+)
+
+func Test_NewSessionFromConn(t *testing.T) {
+	h := server.NewMemHandler()
+	if err := h.WriteFile("/dir/file.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, sc := net.Pipe()
+	go func() { _ = server.New(h).Serve(sc) }()
+	s, err := usftp.NewSessionFromConn(c, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := s.Ls("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 || names[2].Filename != "file.txt" {
+		t.Errorf("got %d names, expected %q in 3 names", len(names), "file.txt")
+	}
+	w := bytes.NewBuffer(nil)
+	if err := s.Get("/dir/file.txt", w); err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != "hello" {
+		t.Errorf("got %q, expected %q", w.String(), "hello")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Ls("/dir"); err == nil {
+		t.Errorf("expected an error after Close")
+	}
+}
+
+func Test_NewSessionFromConn_MaxPacketSize(t *testing.T) {
+	c, sc := net.Pipe()
+	go func() {
+		// read the init request then announce a packet larger than the limit
+		_, _ = usftp.ReadMsg(sc, usftp.DefaultMaxPacketSize)
+		_, _ = sc.Write([]byte{0x7f, 0xff, 0xff, 0xff, usftp.SSH_FXP_VERSION})
+		_, _ = io.Copy(io.Discard, sc)
+	}()
+	_, err := usftp.NewSessionFromConn(c, c, usftp.WithMaxPacketSize(1024))
+	if !errors.Is(err, usftp.ErrMalformedPacket) {
+		t.Errorf("got %v, expected %v", err, usftp.ErrMalformedPacket)
+	}
+}
+
+// fakeServer answers the init request over a net.Pipe, then calls respond for each request until
+// it returns false, after which nothing more is read
+func fakeServer(t *testing.T, respond func(c net.Conn, msg usftp.Msg) bool) net.Conn {
+	c, sc := net.Pipe()
+	t.Cleanup(func() { _ = sc.Close() })
+	go func() {
+		if _, err := usftp.ReadMsg(sc, usftp.DefaultMaxPacketSize); err != nil {
+			return
+		}
+		if err := usftp.WriteMsg(sc, &usftp.VersionResp{Version: 3}); err != nil {
+			return
+		}
+		for {
+			msg, err := usftp.ReadMsg(sc, usftp.DefaultMaxPacketSize)
+			if err != nil || !respond(sc, msg) {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func Test_Session_MalformedResponse(t *testing.T) {
+	c := fakeServer(t, func(c net.Conn, msg usftp.Msg) bool {
+		switch m := msg.(type) {
+		case *usftp.OpenReq:
+			_ = usftp.WriteMsg(c, &usftp.HandleResp{Header: m.Header, Handle: "h"})
+			return true
+		default:
+			// announce a packet larger than the limit and stop reading
+			_, _ = c.Write([]byte{0x7f, 0xff, 0xff, 0xff, usftp.SSH_FXP_DATA})
+			return false
+		}
+	})
+	s, err := usftp.NewSessionFromConn(c, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Get("/a", io.Discard) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, usftp.ErrConnectionLost) || !errors.Is(err, usftp.ErrMalformedPacket) {
+			t.Errorf("got %v, expected a lost connection from a malformed packet", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get did not return")
+	}
+	if _, err := s.Stat("/a"); !errors.Is(err, usftp.ErrConnectionLost) {
+		t.Errorf("got %v, expected %v", err, usftp.ErrConnectionLost)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("expected Close after a failure to succeed, got %v", err)
+	}
+}
+
+func Test_Session_UnsolicitedResponse(t *testing.T) {
+	c := fakeServer(t, func(c net.Conn, msg usftp.Msg) bool {
+		m, ok := msg.(*usftp.StatReq)
+		if !ok {
+			return false
+		}
+		for i := 0; i < 3; i++ {
+			_ = usftp.WriteMsg(c, &usftp.StatusResp{Header: usftp.Header{Id: 999}, ErrorCode: usftp.SSH_FX_OK})
+		}
+		_ = usftp.WriteMsg(c, &usftp.AttrsResp{Header: m.Header, Attrs: usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_SIZE, Size: 5}})
+		return true
+	})
+	s, err := usftp.NewSessionFromConn(c, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+	for i := 0; i < 3; i++ {
+		attrs, err := s.Stat("/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Size != 5 {
+			t.Errorf("got size %d, expected 5", attrs.Size)
+		}
+	}
+}
+
+func Test_Session_MaxPacketSize_Get(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10*1024)
+	h := server.NewMemHandler()
+	if err := h.WriteFile("/a", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, sc := net.Pipe()
+	go func() { _ = server.New(h).Serve(sc) }()
+	s, err := usftp.NewSessionFromConn(c, c, usftp.WithMaxPacketSize(64<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+	var b bytes.Buffer
+	if err := s.Get("/a", &b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Errorf("got %d bytes, expected %d", b.Len(), len(data))
+	}
+}
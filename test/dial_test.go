@@ -0,0 +1,487 @@
+package test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/usftptest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// agentHelper serves a keyring holding a new key on SSH_AUTH_SOCK and returns its public key
+func agentHelper(t *testing.T) ssh.PublicKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = agent.ServeAgent(keyring, c) }()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.PublicKey()
+}
+
+func Test_Dial_Agent(t *testing.T) {
+	srv := usftptest.NewServer(t)
+	srv.Authorize(agentHelper(t))
+	c, err := usftp.Dial(srv.User, srv.Host, srv.Port, "", srv.HostKeyCallback(), usftp.WithAgent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+
+	// combined with a key file which the server does not accept
+	other := usftptest.NewServer(t)
+	c, err = usftp.Dial(srv.User, srv.Host, srv.Port, other.ClientKeyFile(), srv.HostKeyCallback(), usftp.WithAgent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+}
+
+func Test_Dial_Agent_NoSocket(t *testing.T) {
+	srv := usftptest.NewServer(t)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	if _, err := usftp.Dial(srv.User, srv.Host, srv.Port, "", srv.HostKeyCallback(), usftp.WithAgent()); err == nil {
+		t.Errorf("expected an error without SSH_AUTH_SOCK")
+	}
+}
+
+// keyHelper returns a new key as a signer and PEM, encrypted when passphrase is not empty
+func keyHelper(t *testing.T, passphrase string) (ssh.Signer, []byte) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(key, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(block)
+}
+
+func Test_Dial_Passphrase(t *testing.T) {
+	srv := usftptest.NewServer(t)
+	signer, b := keyHelper(t, "secret")
+	srv.Authorize(signer.PublicKey())
+	p := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(p, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if _, err := usftp.Dial(srv.User, srv.Host, srv.Port, p, srv.HostKeyCallback()); !errors.As(err, &missing) {
+		t.Errorf("expected PassphraseMissingError, got %v", err)
+	}
+	var name string
+	c, err := usftp.Dial(srv.User, srv.Host, srv.Port, p, srv.HostKeyCallback(), usftp.WithPassphrase(func(n string) ([]byte, error) {
+		name = n
+		return []byte("secret"), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+	if name != p {
+		t.Errorf("expected passphrase callback for %s, got %s", p, name)
+	}
+	wrong := usftp.WithPassphrase(func(string) ([]byte, error) { return []byte("wrong"), nil })
+	if _, err := usftp.Dial(srv.User, srv.Host, srv.Port, p, srv.HostKeyCallback(), wrong); err == nil {
+		t.Errorf("expected an error with the wrong passphrase")
+	}
+}
+
+func Test_Dial_Identities(t *testing.T) {
+	srv := usftptest.NewServer(t)
+	other := usftptest.NewServer(t)
+
+	// the second identity file is accepted
+	c, err := usftp.Dial(srv.User, srv.Host, srv.Port, other.ClientKeyFile(), srv.HostKeyCallback(), usftp.WithIdentityFile(srv.ClientKeyFile()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+
+	// in memory
+	signer, b := keyHelper(t, "")
+	srv.Authorize(signer.PublicKey())
+	c, err = usftp.Dial(srv.User, srv.Host, srv.Port, "", srv.HostKeyCallback(), usftp.WithPrivateKey(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+
+	// a missing file is reported rather than skipped
+	missing := filepath.Join(t.TempDir(), "missing")
+	_, err = usftp.Dial(srv.User, srv.Host, srv.Port, missing, srv.HostKeyCallback(), usftp.WithPrivateKey(b))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func Test_Dial_Certificate(t *testing.T) {
+	srv := usftptest.NewServer(t)
+	ca, _ := keyHelper(t, "")
+	srv.TrustUserCA(ca.PublicKey())
+
+	signer, b := keyHelper(t, "")
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{srv.User},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	certBytes := ssh.MarshalAuthorizedKey(cert)
+
+	c, err := usftp.Dial(srv.User, srv.Host, srv.Port, "", srv.HostKeyCallback(), usftp.WithCertificate(b, certBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+
+	// without the certificate the key alone is not authorized
+	if _, err := usftp.Dial(srv.User, srv.Host, srv.Port, "", srv.HostKeyCallback(), usftp.WithPrivateKey(b)); err == nil {
+		t.Errorf("expected the key to be refused without its certificate")
+	}
+
+	// loaded from id-cert.pub alongside the identity file
+	dir := t.TempDir()
+	p := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(p, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p+"-cert.pub", certBytes, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err = usftp.Dial(srv.User, srv.Host, srv.Port, p, srv.HostKeyCallback())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+}
+
+func Test_Dial_KnownHosts(t *testing.T) {
+	srv := usftptest.NewServer(t)
+	other := usftptest.NewServer(t)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	// ~/.ssh/known_hosts is missing
+	if _, err := usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), nil); err == nil {
+		t.Errorf("expected an error without known_hosts")
+	}
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, srv.HostKey.PublicKey()) + "\n"
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+
+	// not listed
+	if _, err := usftp.Dial(other.User, other.Host, other.Port, other.ClientKeyFile(), nil); err == nil {
+		t.Errorf("expected an error for an unknown host")
+	}
+	p := filepath.Join(t.TempDir(), "known_hosts")
+	line = knownhosts.Line([]string{knownhosts.Normalize(other.Addr)}, other.HostKey.PublicKey()) + "\n"
+	if err := os.WriteFile(p, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err = usftp.Dial(other.User, other.Host, other.Port, other.ClientKeyFile(), nil, usftp.WithKnownHostsFiles(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+}
+
+func Test_Dial_KnownHosts_Algorithms(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server prefers to present the ECDSA key, only the ed25519 key is known
+	srv := usftptest.NewServer(t, usftptest.WithHostKey(ecdsaKey))
+	p := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, srv.HostKey.PublicKey()) + "\n"
+	if err := os.WriteFile(p, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range []usftp.DialOption{usftp.WithKnownHostsFiles(p), usftp.WithTrustOnFirstUse(p)} {
+		c, err := usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), nil, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != line {
+		t.Errorf("expected %q, got %q", line, string(b))
+	}
+}
+
+func Test_Dial_Fingerprints(t *testing.T) {
+	srv := usftptest.NewServer(t)
+	other := usftptest.NewServer(t)
+	fp := usftp.WithFingerprints(ssh.FingerprintSHA256(other.HostKey.PublicKey()), ssh.FingerprintSHA256(srv.HostKey.PublicKey()))
+	c, err := usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), nil, fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+	fp = usftp.WithFingerprints(ssh.FingerprintSHA256(other.HostKey.PublicKey()))
+	if _, err := usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), nil, fp); err == nil {
+		t.Errorf("expected an error for a fingerprint mismatch")
+	}
+}
+
+func Test_Dial_TrustOnFirstUse(t *testing.T) {
+	srv := usftptest.NewServer(t)
+	p := filepath.Join(t.TempDir(), "ssh", "known_hosts")
+	for i := 0; i < 2; i++ {
+		c, err := usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), nil, usftp.WithTrustOnFirstUse(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.Close()
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, srv.HostKey.PublicKey()) + "\n"
+	if string(b) != expected {
+		t.Errorf("expected %q, got %q", expected, string(b))
+	}
+
+	// a changed key is refused
+	other, _ := keyHelper(t, "")
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, other.PublicKey()) + "\n"
+	if err := os.WriteFile(p, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), nil, usftp.WithTrustOnFirstUse(p))
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		t.Errorf("expected KeyError, got %v", err)
+	}
+}
+
+func Test_Dial_Password(t *testing.T) {
+	srv := usftptest.NewServer(t, usftptest.WithPassword("secret"))
+	c, err := usftp.Dial(srv.User, srv.Host, srv.Port, "", srv.HostKeyCallback(), usftp.WithPassword("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+	if _, err := usftp.Dial(srv.User, srv.Host, srv.Port, "", srv.HostKeyCallback(), usftp.WithPassword("wrong")); err == nil {
+		t.Errorf("expected an error with the wrong password")
+	}
+	calls := 0
+	c, err = usftp.Dial(srv.User, srv.Host, srv.Port, "", srv.HostKeyCallback(), usftp.WithPasswordCallback(func() (string, error) {
+		calls++
+		return "secret", nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+
+	// after a public key which is refused
+	other := usftptest.NewServer(t)
+	c, err = usftp.Dial(srv.User, srv.Host, srv.Port, other.ClientKeyFile(), srv.HostKeyCallback(), usftp.WithPassword("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+}
+
+func Test_Dial_KeyboardInteractive(t *testing.T) {
+	srv := usftptest.NewServer(t, usftptest.WithPassword("secret"))
+	var questions []string
+	challenge := func(name, instruction string, qs []string, echos []bool) ([]string, error) {
+		questions = append(questions, qs...)
+		return []string{"secret"}, nil
+	}
+	c, err := usftp.Dial(srv.User, srv.Host, srv.Port, "", srv.HostKeyCallback(), usftp.WithKeyboardInteractive(challenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+	if len(questions) != 1 || questions[0] != "Password: " {
+		t.Errorf("unexpected questions %v", questions)
+	}
+}
+
+func Test_Dial_Options(t *testing.T) {
+	srv := usftptest.NewServer(t, usftptest.WithBanner("welcome\n"))
+	var banner string
+	c, err := usftp.Dial(
+		srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), srv.HostKeyCallback(),
+		usftp.WithTimeout(5*time.Second),
+		usftp.WithCiphers("aes256-ctr"),
+		usftp.WithKeyExchanges("curve25519-sha256"),
+		usftp.WithMACs("hmac-sha2-256"),
+		usftp.WithClientVersion("SSH-2.0-usftp-test"),
+		usftp.WithBannerCallback(func(message string) error {
+			banner = message
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+	if string(c.ClientVersion()) != "SSH-2.0-usftp-test" {
+		t.Errorf("unexpected client version %s", c.ClientVersion())
+	}
+	if banner != "welcome\n" {
+		t.Errorf("unexpected banner %q", banner)
+	}
+
+	// no algorithm in common
+	if _, err := usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), srv.HostKeyCallback(), usftp.WithCiphers("unknown")); err == nil {
+		t.Errorf("expected an error without a common cipher")
+	}
+}
+
+func Test_Dial_Timeout(t *testing.T) {
+	srv := usftptest.NewServer(t)
+	srv.Stall()
+	start := time.Now()
+	if _, err := usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), srv.HostKeyCallback(), usftp.WithTimeout(200*time.Millisecond)); err == nil {
+		t.Errorf("expected a timeout")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("timeout took %s", d)
+	}
+}
+
+func Test_Dial_Keepalive(t *testing.T) {
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", "a"))
+	c, err := usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), srv.HostKeyCallback(), usftp.WithKeepalive(50*time.Millisecond, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := usftp.NewSession(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+
+	// answered keepalives leave the connection open
+	time.Sleep(200 * time.Millisecond)
+	if _, err := s.Ls("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Stall()
+	result := make(chan error, 1)
+	go func() {
+		_, err := s.Ls("/")
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Errorf("expected an error once the server stopped responding")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not fail after missed keepalives")
+	}
+}
+
+func Test_Dial_JumpHost(t *testing.T) {
+	jump1 := usftptest.NewServer(t, usftptest.WithForwarding(), usftptest.WithUser("bastion"))
+	jump2 := usftptest.NewServer(t, usftptest.WithForwarding(), usftptest.WithPassword("secret"))
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", "a"))
+
+	c, err := usftp.Dial(
+		srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), srv.HostKeyCallback(),
+		usftp.WithJumpHost(jump1.User, jump1.Host, jump1.Port, usftp.WithIdentityFile(jump1.ClientKeyFile()), usftp.WithFingerprints(ssh.FingerprintSHA256(jump1.HostKey.PublicKey()))),
+		usftp.WithJumpHost(jump2.User, jump2.Host, jump2.Port, usftp.WithPassword("secret"), usftp.WithFingerprints(ssh.FingerprintSHA256(jump2.HostKey.PublicKey()))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := usftp.NewSession(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+	var b bytes.Buffer
+	if err := s.Get("/a", &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "a" {
+		t.Errorf("expected a, got %s", b.String())
+	}
+
+	// a jump host refusing authentication
+	_, err = usftp.Dial(
+		srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), srv.HostKeyCallback(),
+		usftp.WithJumpHost(jump1.User, jump1.Host, jump1.Port, usftp.WithPassword("wrong"), usftp.WithInsecureIgnoreHostKey()),
+	)
+	if err == nil {
+		t.Errorf("expected an error when the jump host refuses authentication")
+	}
+}
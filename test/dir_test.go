@@ -0,0 +1,281 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/server"
+	"github.com/richardjennings/usftp/usftptest"
+)
+
+func Test_DownloadDir(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := server.NewMemHandler()
+	files := map[string]string{"/d/a": "a", "/d/sub/b": "bb", "/d/sub/deeper/c": strings.Repeat("c", 300*1024)}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("/d/many/%d", i)] = fmt.Sprint(i)
+	}
+	if err := h.MkdirAll("/d/sub/deeper", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.MkdirAll("/d/many", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var total uint64
+	for name, data := range files {
+		if err := h.WriteFile(name, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+		total += uint64(len(data))
+	}
+	attrs := usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_ACMODTIME, Atime: uint32(mtime.Unix()), Mtime: uint32(mtime.Unix())}
+	for _, name := range []string{"/d/a", "/d/sub/deeper/c", "/d/sub", "/d"} {
+		if err := h.Setstat(name, attrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := usftptest.NewServer(t, usftptest.WithHandler(h))
+	s := srv.Session()
+	dir := filepath.Join(t.TempDir(), "d")
+
+	var stats usftp.TransferStats
+	progressed := map[string]bool{}
+	err := s.DownloadDir("/d", dir, usftp.WithConcurrency(3), usftp.WithStats(&stats), usftp.WithProgress(func(p usftp.Progress) {
+		progressed[p.Path] = true
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(name, "/d/")))
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("%s: expected %d bytes, got %d", name, len(data), len(b))
+		}
+		if !progressed[name] && data != "" {
+			t.Errorf("%s: expected progress", name)
+		}
+	}
+	if stats.Bytes != total {
+		t.Errorf("expected %d bytes, got %d", total, stats.Bytes)
+	}
+	for _, tc := range []struct {
+		path  string
+		perm  os.FileMode
+		mtime bool
+	}{
+		{"a", 0640, true},
+		{"sub", 0750, true},
+		{"sub/deeper", 0750, false},
+		{"sub/deeper/c", 0640, true},
+		{"", 0, true},
+	} {
+		fi, err := os.Stat(filepath.Join(dir, tc.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.perm != 0 && fi.Mode().Perm() != tc.perm {
+			t.Errorf("%s: expected %s, got %s", tc.path, tc.perm, fi.Mode().Perm())
+		}
+		if tc.mtime && !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: expected %s, got %s", tc.path, mtime, fi.ModTime())
+		}
+	}
+
+	if err := s.DownloadDir("/d/a", t.TempDir()); err == nil {
+		t.Errorf("expected an error for a file")
+	}
+	if err := s.DownloadDir("/d", dir, usftp.WithOverwrite(usftp.OverwriteNever)); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected an exist error, got %v", err)
+	}
+}
+
+func Test_DownloadDir_Relative(t *testing.T) {
+	h := server.NewMemHandler()
+	if err := h.MkdirAll("/d/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"/d/a": "a", "/d/sub/b": "b"}
+	for name, data := range files {
+		if err := h.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := usftptest.NewServer(t, usftptest.WithHandler(h))
+	s := srv.Session()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	// top level files are bare filenames, their temporary files must not go to TMPDIR
+	t.Setenv("TMPDIR", filepath.Join(dir, "missing"))
+
+	if err := s.DownloadDir("/d", "."); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(name, "/d/"))))
+		if err != nil || string(b) != data {
+			t.Errorf("%s: expected %q, got %q %v", name, data, b, err)
+		}
+	}
+}
+
+func Test_UploadDir(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dir := t.TempDir()
+	files := map[string]string{"a": "a", "sub/b": "bb", "sub/deeper/c": strings.Repeat("c", 300*1024), "skip.tmp": "x", "sub/skip.tmp": "x", "cache/d": "d"}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("many/%d", i)] = fmt.Sprint(i)
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a", "sub/deeper/c", "sub/deeper", "sub", ""} {
+		if err := os.Chtimes(filepath.Join(dir, filepath.FromSlash(name)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := usftptest.NewServer(t, usftptest.WithHandler(server.NewMemHandler()))
+	s := srv.Session()
+
+	var stats usftp.TransferStats
+	err := s.UploadDir(dir, "/up/d", usftp.WithConcurrency(3), usftp.WithStats(&stats), usftp.WithAtomic(), usftp.WithExclude("*.tmp", "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total uint64
+	for name, data := range files {
+		var b bytes.Buffer
+		err := s.Get("/up/d/"+name, &b)
+		if strings.HasSuffix(name, ".tmp") || strings.HasPrefix(name, "cache/") {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("%s: expected to be excluded, got %v", name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != data {
+			t.Errorf("%s: expected %d bytes, got %d", name, len(data), b.Len())
+		}
+		total += uint64(len(data))
+	}
+	if stats.Bytes != total {
+		t.Errorf("expected %d bytes, got %d", total, stats.Bytes)
+	}
+	for _, tc := range []struct {
+		path  string
+		perm  os.FileMode
+		mtime bool
+	}{
+		{"a", 0640, true},
+		{"sub", 0750, true},
+		{"sub/deeper", 0750, true},
+		{"sub/deeper/c", 0640, true},
+		{"many/0", 0640, false},
+		{"", 0, true},
+	} {
+		attrs, err := s.Stat(path.Join("/up/d", tc.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.perm != 0 && attrs.Permissions.FsFileMode().Perm() != tc.perm {
+			t.Errorf("%s: expected %s, got %s", tc.path, tc.perm, attrs.Permissions.FsFileMode().Perm())
+		}
+		if tc.mtime && int64(attrs.Mtime) != mtime.Unix() {
+			t.Errorf("%s: expected %s, got %s", tc.path, mtime, time.Unix(int64(attrs.Mtime), 0))
+		}
+	}
+
+	if err := s.UploadDir(filepath.Join(dir, "a"), "/up/a"); err == nil {
+		t.Errorf("expected an error for a file")
+	}
+	if err := s.UploadDir(dir, "/up/bad", usftp.WithInclude("[")); err == nil {
+		t.Errorf("expected an error for a bad pattern")
+	}
+}
+
+func Test_UploadDir_Include(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.log", "sub/c.txt", "sub/d.log"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := usftptest.NewServer(t, usftptest.WithHandler(server.NewMemHandler()))
+	s := srv.Session()
+	if err := s.UploadDir(dir, "/d", usftp.WithInclude("*.txt"), usftp.WithExclude("sub/c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := s.Find("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	var visit func(files []*usftp.NameRespFile)
+	visit = func(files []*usftp.NameRespFile) {
+		for _, f := range files {
+			if f.Filename == "." || f.Filename == ".." {
+				continue
+			}
+			if !f.Attrs.Permissions.IsDir() {
+				names = append(names, path.Join(f.Path, f.Filename))
+			}
+			visit(f.Children)
+		}
+	}
+	visit(files)
+	if strings.Join(names, ",") != "/d/a.txt" {
+		t.Errorf("expected only /d/a.txt, got %v", names)
+	}
+}
+
+func Test_MkdirAll(t *testing.T) {
+	h := server.NewMemHandler()
+	if err := h.WriteFile("/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := usftptest.NewServer(t, usftptest.WithHandler(h))
+	s := srv.Session()
+	if err := s.MkdirAll("/a/b/c", 0700); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := s.Stat("/a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attrs.Permissions.IsDir() || attrs.Permissions.FsFileMode().Perm() != 0700 {
+		t.Errorf("expected a directory with 0700, got %s", attrs.Permissions)
+	}
+	if err := s.MkdirAll("/a/b", 0700); err != nil {
+		t.Errorf("expected an existing directory to succeed, got %v", err)
+	}
+	if err := s.MkdirAll("/file/a", 0700); err == nil {
+		t.Errorf("expected an error below a file")
+	}
+	if err := s.Mkdir("/a", 0700); err == nil {
+		t.Errorf("expected an error for an existing directory")
+	}
+}
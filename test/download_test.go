@@ -0,0 +1,136 @@
+package test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/server"
+	"github.com/richardjennings/usftp/usftptest"
+)
+
+// memHelper returns a MemHandler holding name with data, perm and mtime
+func memHelper(t *testing.T, name string, data string, perm fs.FileMode, mtime time.Time) *server.MemHandler {
+	h := server.NewMemHandler()
+	if err := h.WriteFile(name, []byte(data), perm); err != nil {
+		t.Fatal(err)
+	}
+	attrs := usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_ACMODTIME, Atime: uint32(mtime.Unix()), Mtime: uint32(mtime.Unix())}
+	if err := h.Setstat(name, attrs); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func Test_Download(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := usftptest.NewServer(t, usftptest.WithHandler(memHelper(t, "/share/a", "remote", 0640, mtime)))
+	s := srv.Session()
+	dir := t.TempDir()
+	p := filepath.Join(dir, "a")
+
+	if err := s.Download("/share/a", p); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "remote" {
+		t.Errorf("expected remote, got %s", b)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("expected 0640, got %s", fi.Mode().Perm())
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("expected %s, got %s", mtime, fi.ModTime())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the downloaded file, got %d entries", len(entries))
+	}
+
+	// a failed download leaves the existing file in place
+	if err := s.Download("/share/missing", p); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	if err := s.Download("/share", filepath.Join(dir, "share")); err == nil {
+		t.Errorf("expected an error for a directory")
+	}
+}
+
+func Test_Download_Overwrite(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	srv := usftptest.NewServer(t, usftptest.WithHandler(memHelper(t, "/a", "remote", 0644, mtime)))
+	s := srv.Session()
+
+	tcs := []struct {
+		name     string
+		local    string
+		mtime    time.Time
+		opts     []usftp.TransferOption
+		expected string
+		err      error
+	}{
+		{"always", "local", mtime, nil, "remote", nil},
+		{"never", "local", mtime, []usftp.TransferOption{usftp.WithOverwrite(usftp.OverwriteNever)}, "local", fs.ErrExist},
+		{"newer remote", "local", mtime.Add(-time.Hour), []usftp.TransferOption{usftp.WithOverwrite(usftp.OverwriteIfNewer)}, "remote", nil},
+		{"older remote", "local", mtime.Add(time.Hour), []usftp.TransferOption{usftp.WithOverwrite(usftp.OverwriteIfNewer)}, "local", nil},
+		{"unchanged", "abcdef", mtime, []usftp.TransferOption{usftp.WithSkipUnchanged()}, "abcdef", nil},
+		{"changed size", "abc", mtime, []usftp.TransferOption{usftp.WithSkipUnchanged()}, "remote", nil},
+		{"changed time", "abcdef", mtime.Add(time.Second), []usftp.TransferOption{usftp.WithSkipUnchanged()}, "remote", nil},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "a")
+			if err := os.WriteFile(p, []byte(tc.local), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(p, tc.mtime, tc.mtime); err != nil {
+				t.Fatal(err)
+			}
+			err := s.Download("/a", p, tc.opts...)
+			if tc.err == nil && err != nil || !errors.Is(err, tc.err) {
+				t.Errorf("expected %v, got %v", tc.err, err)
+			}
+			b, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, b)
+			}
+		})
+	}
+}
+
+func Test_Download_Relative(t *testing.T) {
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", "remote"))
+	s := srv.Session()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	// the temporary file belongs next to the target, not in TMPDIR
+	t.Setenv("TMPDIR", filepath.Join(dir, "missing"))
+
+	if err := s.Download("/a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "remote" {
+		t.Errorf("expected remote, got %s", b)
+	}
+}
@@ -0,0 +1,71 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/richardjennings/usftp"
+)
+
+func Test_Decode_Short(t *testing.T) {
+	if _, _, err := usftp.Uint32([]byte{0, 0, 1}); !errors.Is(err, usftp.ErrMalformedPacket) {
+		t.Errorf("got %v, expected %v", err, usftp.ErrMalformedPacket)
+	}
+	if _, _, err := usftp.Uint64([]byte{0, 0, 0, 0, 0, 0, 1}); !errors.Is(err, usftp.ErrMalformedPacket) {
+		t.Errorf("got %v, expected %v", err, usftp.ErrMalformedPacket)
+	}
+	// length prefix claims more bytes than remain
+	if _, _, err := usftp.String([]byte{0, 0, 0, 5, 'a', 'b'}); !errors.Is(err, usftp.ErrMalformedPacket) {
+		t.Errorf("got %v, expected %v", err, usftp.ErrMalformedPacket)
+	}
+	if _, _, err := usftp.String([]byte{0xff, 0xff, 0xff, 0xff}); !errors.Is(err, usftp.ErrMalformedPacket) {
+		t.Errorf("got %v, expected %v", err, usftp.ErrMalformedPacket)
+	}
+	v, rest, err := usftp.String([]byte{0, 0, 0, 1, 'a', 'b'})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "a" || string(rest) != "b" {
+		t.Errorf("got %q %q, expected %q %q", v, rest, "a", "b")
+	}
+}
+
+func Test_Unmarshal_Truncated(t *testing.T) {
+	// a NameResp with one entry whose attrs claim a size that is not present
+	b := []byte{
+		0, 0, 0, 1, // id
+		0, 0, 0, 1, // count
+		0, 0, 0, 1, 'a', // filename
+		0, 0, 0, 0, // longname
+		0, 0, 0, 1, // flags SSH_FILEXFER_ATTR_SIZE
+		0, 0, 0, // truncated size
+	}
+	err := (&usftp.NameResp{}).UnmarshalBinary(b)
+	var mErr *usftp.MalformedPacketError
+	if !errors.As(err, &mErr) {
+		t.Fatalf("got %v, expected a MalformedPacketError", err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 1, 'a'})
+	f.Add([]byte{0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 'a', 0, 0, 0, 0, 0x80, 0, 0, 0x0f, 0, 0, 0, 0, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_, _, _ = usftp.Uint32(b)
+		_, _, _ = usftp.Uint64(b)
+		_, _, _ = usftp.String(b)
+		_, _, _ = usftp.Bytes(b)
+		var msgs []usftp.Msg
+		for i := 1; i <= 255; i++ {
+			if m, err := usftp.NewMsg(uint8(i)); err == nil {
+				msgs = append(msgs, m)
+			}
+		}
+		for _, m := range msgs {
+			if err := m.UnmarshalBinary(b); err != nil && !errors.Is(err, usftp.ErrMalformedPacket) {
+				t.Errorf("%T: got %v, expected a malformed packet error", m, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/server"
+	"github.com/richardjennings/usftp/usftptest"
+)
+
+const sftpServerCommand = "/usr/lib/openssh/sftp-server"
+
+func Test_WithCommand(t *testing.T) {
+	srv := usftptest.NewServer(t, usftptest.WithExecCommands(sftpServerCommand), usftptest.WithFile("/a.txt", "a"))
+	s, err := usftp.NewSession(srv.Client(), usftp.WithCommand(sftpServerCommand))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+	w := bytes.NewBuffer(nil)
+	if err := s.Get("/a.txt", w); err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != "a" {
+		t.Errorf("got %q, expected %q", w.String(), "a")
+	}
+	if _, err := usftp.NewSession(srv.Client(), usftp.WithCommand("/bin/sh")); err == nil {
+		t.Errorf("expected an error executing a command that is not an sftp server")
+	}
+}
+
+// Test_HelperServer is not a test, it serves SFTP over stdin and stdout when run as a
+// subprocess by Test_NewSessionFromCmd
+func Test_HelperServer(t *testing.T) {
+	if os.Getenv("USFTP_HELPER_SERVER") != "1" {
+		t.Skip("helper process")
+	}
+	h := server.NewMemHandler()
+	_ = h.WriteFile("/a.txt", []byte("a"), 0644)
+	_ = server.New(h).Serve(struct {
+		io.Reader
+		io.WriteCloser
+	}{os.Stdin, os.Stdout})
+	os.Exit(0)
+}
+
+func Test_NewSessionFromCmd(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^Test_HelperServer$")
+	cmd.Env = append(os.Environ(), "USFTP_HELPER_SERVER=1")
+	s, err := usftp.NewSessionFromCmd(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bytes.NewBuffer(nil)
+	if err := s.Get("/a.txt", w); err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != "a" {
+		t.Errorf("got %q, expected %q", w.String(), "a")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
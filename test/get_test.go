@@ -0,0 +1,97 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/richardjennings/usftp/usftptest"
+)
+
+func Test_GetRange(t *testing.T) {
+	data := strings.Repeat("0123456789", 60*1024)
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", data))
+	s := srv.Session()
+	tcs := []struct {
+		name     string
+		offset   int64
+		length   int64
+		expected string
+	}{
+		{"start", 0, 10, data[:10]},
+		{"middle", 5, 12, data[5:17]},
+		{"rest", 300 * 1024, -1, data[300*1024:]},
+		{"several reads", 1, 500 * 1024, data[1 : 500*1024+1]},
+		{"past the end", int64(len(data)) - 5, 100, data[len(data)-5:]},
+		{"after the end", int64(len(data)) + 5, 100, ""},
+		{"empty", 10, 0, ""},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := s.GetRange("/a", tc.offset, tc.length, &b); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tc.expected {
+				t.Errorf("expected %d bytes, got %d", len(tc.expected), b.Len())
+			}
+		})
+	}
+	if err := s.GetRange("/a", -1, 1, &bytes.Buffer{}); err == nil {
+		t.Errorf("expected an error for a negative offset")
+	}
+}
+
+func Test_ResumeGet(t *testing.T) {
+	data := strings.Repeat("0123456789", 60*1024)
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", data))
+	s := srv.Session()
+	dir := t.TempDir()
+
+	for _, partial := range []int{-1, 0, 1, 300 * 1024, len(data)} {
+		p := filepath.Join(dir, "a")
+		_ = os.Remove(p)
+		if partial >= 0 {
+			if err := os.WriteFile(p, []byte(data[:partial]), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.ResumeGet("/a", p); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("partial %d: expected %d bytes, got %d", partial, len(data), len(b))
+		}
+	}
+
+	// a local file larger than the remote is not a partial download
+	p := filepath.Join(dir, "large")
+	if err := os.WriteFile(p, []byte(data+"x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResumeGet("/a", p); err == nil {
+		t.Errorf("expected an error for a larger local file")
+	}
+	if err := s.ResumeGet("/missing", filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error for a missing remote file")
+	}
+}
+
+func Test_Client_GetRange(t *testing.T) {
+	data := strings.Repeat("0123456789", 100*1024)
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", data))
+	c := clientHelper(t, srv)
+	w := &dropWriter{srv: srv}
+	if err := c.GetRange("/a", 3, 600*1024, w); err != nil {
+		t.Fatal(err)
+	}
+	if w.String() != data[3:600*1024+3] {
+		t.Errorf("expected %d bytes, got %d", 600*1024, w.Len())
+	}
+}
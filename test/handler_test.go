@@ -0,0 +1,235 @@
+package test
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/server"
+)
+
+func handlers(t *testing.T) map[string]server.Handler {
+	local, err := server.NewLocalHandler(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]server.Handler{"local": local, "memory": server.NewMemHandler()}
+}
+
+func Test_Handler(t *testing.T) {
+	for name, h := range handlers(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := h.Mkdir("/dir", usftp.Attrs{}); err != nil {
+				t.Fatal(err)
+			}
+			f, err := h.Open("/dir/a.txt", usftp.SSH_FXF_READ|usftp.SSH_FXF_WRITE|usftp.SSH_FXF_CREAT, usftp.Attrs{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.WriteAt([]byte("hello"), 0); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 10)
+			n, err := f.ReadAt(b, 1)
+			if err != io.EOF || string(b[:n]) != "ello" {
+				t.Errorf("got %q %v, expected %q %v", b[:n], err, "ello", io.EOF)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+			attrs, err := h.Stat("/dir/a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attrs.Size != 5 || !attrs.Permissions.IsRegular() {
+				t.Errorf("got size %d mode %s, expected size 5 regular file", attrs.Size, attrs.Permissions)
+			}
+			if err := h.Symlink("a.txt", "/dir/link"); err != nil {
+				t.Fatal(err)
+			}
+			if attrs, err := h.Lstat("/dir/link"); err != nil || !attrs.Permissions.IsSymlink() {
+				t.Errorf("got %s %v, expected a symlink", attrs.Permissions, err)
+			}
+			if attrs, err := h.Stat("/dir/link"); err != nil || attrs.Size != 5 {
+				t.Errorf("got size %d %v, expected the size of the link target", attrs.Size, err)
+			}
+			if _, err := h.Open("/dir/b.txt", usftp.SSH_FXF_READ, usftp.Attrs{}); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("got %v, expected %v", err, fs.ErrNotExist)
+			}
+			if err := h.Rename("/dir/a.txt", "/dir/link"); err == nil {
+				t.Errorf("expected rename over an existing file to fail")
+			}
+			if err := h.(server.PosixRenamer).PosixRename("/dir/a.txt", "/dir/b.txt"); err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Rmdir("/dir"); err == nil {
+				t.Errorf("expected removing a non empty directory to fail")
+			}
+			names, err := h.ReadDir("/dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 2 {
+				t.Errorf("got %d names, expected %d", len(names), 2)
+			}
+			for _, n := range []string{"/dir/b.txt", "/dir/link"} {
+				if err := h.Remove(n); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := h.Rmdir("/dir"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func Test_LocalHandler_Escape(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(root, "up")); err != nil {
+		t.Fatal(err)
+	}
+	h, err := server.NewLocalHandler(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/out/secret", "/up/secret", "/up/missing"} {
+		if _, err := h.Open(name, usftp.SSH_FXF_READ, usftp.Attrs{}); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("%s: got %v, expected %v", name, err, fs.ErrPermission)
+		}
+	}
+	if _, err := h.Open("/missing", usftp.SSH_FXF_READ, usftp.Attrs{}); !errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		t.Errorf("got %v, expected %v", err, fs.ErrNotExist)
+	}
+	if _, err := h.Open("/secret", usftp.SSH_FXF_READ, usftp.Attrs{}); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("got %v, expected %v", err, fs.ErrPermission)
+	}
+	if _, err := h.ReadDir("/out"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("got %v, expected %v", err, fs.ErrPermission)
+	}
+	// the link itself is inside root
+	if attrs, err := h.Lstat("/secret"); err != nil || !attrs.Permissions.IsSymlink() {
+		t.Errorf("got %s %v, expected a symlink", attrs.Permissions, err)
+	}
+	// the server cleans names before they reach the handler, the handler does so too
+	names, err := h.ReadDir("/../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Errorf("got %d names, expected the 3 entries of root", len(names))
+	}
+}
+
+func Test_LocalHandler_Readlink(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"abs-out":     filepath.Join(dir, "secret"),
+		"abs-in":      filepath.Join(root, "sub", "a"),
+		"sub/rel-in":  "../a",
+		"sub/rel-out": "../../secret",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := server.NewLocalHandler(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		name     string
+		expected string
+	}{
+		{"/abs-in", "/sub/a"},
+		{"/sub/rel-in", "../a"},
+		{"/abs-out", ""},
+		{"/sub/rel-out", ""},
+	}
+	for _, tc := range tcs {
+		target, err := h.Readlink(tc.name)
+		if tc.expected == "" {
+			if !errors.Is(err, fs.ErrPermission) {
+				t.Errorf("%s: got %q %v, expected %v", tc.name, target, err, fs.ErrPermission)
+			}
+			continue
+		}
+		if err != nil || target != tc.expected {
+			t.Errorf("%s: got %q %v, expected %q", tc.name, target, err, tc.expected)
+		}
+	}
+}
+
+func Test_LocalHandler_Chown(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	attrs := usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_UIDGID, Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	h, err := server.NewLocalHandler(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Setstat("/a", attrs); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("got %v, expected %v", err, fs.ErrPermission)
+	}
+	f, err := h.Open("/a", usftp.SSH_FXF_WRITE, usftp.Attrs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	if err := f.Setstat(attrs); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("got %v, expected %v", err, fs.ErrPermission)
+	}
+	h, err = server.NewLocalHandler(root, server.WithChown())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changing to the current owner is always permitted
+	if err := h.Setstat("/a", attrs); err != nil {
+		t.Errorf("expected chown to be allowed, got %v", err)
+	}
+}
+
+func Test_MemHandler_RenameIntoItself(t *testing.T) {
+	h := server.NewMemHandler()
+	if err := h.Mkdir("/a", usftp.Attrs{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Symlink("/a", "/l"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a/b", "/l/b"} {
+		if err := h.Rename("/a", name); err == nil {
+			t.Errorf("%s: expected renaming a directory below itself to fail", name)
+		}
+	}
+	if attrs, err := h.Stat("/a"); err != nil || !attrs.Permissions.IsDir() {
+		t.Errorf("expected /a to remain, got %s %v", attrs.Permissions, err)
+	}
+	if err := h.Rename("/a", "/c"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,108 @@
+package test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/richardjennings/usftp"
+)
+
+func Test_Golden(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  usftp.Msg
+		hex  string
+	}{
+		{"init", &usftp.InitReq{Version: 3}, "000000050100000003"},
+		{"init extensions", &usftp.InitReq{Version: 3, Extensions: []usftp.Extension{{Name: "a@b", Data: "1"}}}, "000000110100000003000000036140620000000131"},
+		{"version", &usftp.VersionResp{Version: 3, Extensions: []usftp.Extension{{Name: "posix-rename@openssh.com", Data: "1"}}}, "00000026020000000300000018706f7369782d72656e616d65406f70656e7373682e636f6d0000000131"},
+		{"open", &usftp.OpenReq{Header: usftp.Header{Id: 1}, Filename: "/f", Pflags: usftp.SSH_FXF_WRITE | usftp.SSH_FXF_CREAT | usftp.SSH_FXF_TRUNC, Attrs: usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_PERMISSIONS, Permissions: 0644}}, "000000170300000001000000022f660000001a00000004000001a4"},
+		{"close", &usftp.CloseReq{Header: usftp.Header{Id: 2}, Handle: "h"}, "0000000a04000000020000000168"},
+		{"read", &usftp.ReadReq{Header: usftp.Header{Id: 3}, Handle: "h", Offset: 1024, Len: 4096}, "0000001605000000030000000168000000000000040000001000"},
+		{"write", &usftp.WriteReq{Header: usftp.Header{Id: 4}, Handle: "h", Offset: 2, Data: []byte("ab")}, "00000018060000000400000001680000000000000002000000026162"},
+		{"lstat", &usftp.LstatReq{Header: usftp.Header{Id: 5}, Path: "/l"}, "0000000b0700000005000000022f6c"},
+		{"fstat", &usftp.FstatReq{Header: usftp.Header{Id: 6}, Handle: "h"}, "0000000a08000000060000000168"},
+		{"setstat", &usftp.SetstatReq{Header: usftp.Header{Id: 7}, Path: "/f", Attrs: usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_ACMODTIME, Atime: 10, Mtime: 20}}, "000000170900000007000000022f66000000080000000a00000014"},
+		{"fsetstat", &usftp.FsetstatReq{Header: usftp.Header{Id: 8}, Handle: "h", Attrs: usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_SIZE}}, "000000160a000000080000000168000000010000000000000000"},
+		{"opendir", &usftp.OpenDirReq{Header: usftp.Header{Id: 9}, Path: "/d"}, "0000000b0b00000009000000022f64"},
+		{"readdir", &usftp.ReadDirReq{Header: usftp.Header{Id: 10}, Handle: "h"}, "0000000a0c0000000a0000000168"},
+		{"remove", &usftp.RemoveReq{Header: usftp.Header{Id: 11}, Filename: "/f"}, "0000000b0d0000000b000000022f66"},
+		{"mkdir", &usftp.MkdirReq{Header: usftp.Header{Id: 12}, Path: "/d", Attrs: usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_PERMISSIONS, Permissions: 0755}}, "000000130e0000000c000000022f6400000004000001ed"},
+		{"rmdir", &usftp.RmdirReq{Header: usftp.Header{Id: 13}, Path: "/d"}, "0000000b0f0000000d000000022f64"},
+		{"realpath", &usftp.RealpathReq{Header: usftp.Header{Id: 14}, Path: "."}, "0000000a100000000e000000012e"},
+		{"stat", &usftp.StatReq{Header: usftp.Header{Id: 15}, Path: "/f"}, "0000000b110000000f000000022f66"},
+		{"rename", &usftp.RenameReq{Header: usftp.Header{Id: 16}, OldPath: "/a", NewPath: "/b"}, "000000111200000010000000022f61000000022f62"},
+		{"readlink", &usftp.ReadlinkReq{Header: usftp.Header{Id: 17}, Path: "/l"}, "0000000b1300000011000000022f6c"},
+		{"symlink", &usftp.SymlinkReq{Header: usftp.Header{Id: 18}, LinkPath: "/l", TargetPath: "/t"}, "000000111400000012000000022f6c000000022f74"},
+		{"status", &usftp.StatusResp{Header: usftp.Header{Id: 19}, ErrorCode: usftp.SSH_FX_NO_SUCH_FILE, ErrorMessage: "no such file", LanguageTag: "en"}, "0000001f6500000013000000020000000c6e6f20737563682066696c6500000002656e"},
+		{"handle", &usftp.HandleResp{Header: usftp.Header{Id: 20}, Handle: "h"}, "0000000a66000000140000000168"},
+		{"data", &usftp.DataResp{Header: usftp.Header{Id: 21}, Data: []byte("abc")}, "0000000c670000001500000003616263"},
+		{"name", &usftp.NameResp{Header: usftp.Header{Id: 22}, Count: 1, Names: []*usftp.NameRespFile{{
+			Filename: "f",
+			Longname: "-rw-r--r-- f",
+			Attrs: usftp.Attrs{
+				Flags:       usftp.SSH_FILEXFER_ATTR_SIZE | usftp.SSH_FILEXFER_ATTR_UIDGID | usftp.SSH_FILEXFER_ATTR_PERMISSIONS | usftp.SSH_FILEXFER_ATTR_ACMODTIME | usftp.SSH_FILEXFER_ATTR_EXTENDED,
+				Size:        5,
+				Uid:         1000,
+				Gid:         100,
+				Permissions: usftp.ModeRegular | 0644,
+				Atime:       10,
+				Mtime:       20,
+				Extended:    []usftp.Extension{{Name: "a@b", Data: "c"}},
+				// the deprecated fields are filled when decoding
+				ExtendedCount: 1,
+				ExtendedType:  "a@b",
+				ExtendedData:  "c",
+			},
+		}}}, "0000004e68000000160000000100000001660000000c2d72772d722d2d722d2d20668000000f0000000000000005000003e800000064000081a40000000a0000001400000001000000036140620000000163"},
+		{"attrs", &usftp.AttrsResp{Header: usftp.Header{Id: 23}, Attrs: usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_SIZE, Size: 7}}, "000000116900000017000000010000000000000007"},
+		{"extended", &usftp.ExtendedReq{Header: usftp.Header{Id: 24}, Request: "fsync@openssh.com", Data: []byte{0, 0, 0, 1, 'h'}}, "0000001fc800000018000000116673796e63406f70656e7373682e636f6d0000000168"},
+		{"extended reply", &usftp.ExtendedReplyResp{Header: usftp.Header{Id: 25}, Data: []byte{1, 2}}, "00000007c9000000190102"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			if err := usftp.WriteMsg(buf, tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			if actual := hex.EncodeToString(buf.Bytes()); actual != tt.hex {
+				t.Errorf("got %s, expected %s", actual, tt.hex)
+			}
+			msg, err := usftp.ReadMsg(buf, usftp.DefaultMaxPacketSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(msg, tt.msg) {
+				t.Errorf("got %+v, expected %+v", msg, tt.msg)
+			}
+		})
+	}
+}
+
+func Test_ReadMsg_TooLarge(t *testing.T) {
+	b, _ := hex.DecodeString("0000001605000000030000000168000000000000040000001000")
+	if _, err := usftp.ReadMsg(bytes.NewReader(b), 0x15); err == nil {
+		t.Errorf("expected an error for a packet larger than the maximum")
+	}
+	if _, err := usftp.ReadMsg(bytes.NewReader([]byte{0, 0, 0, 0}), usftp.DefaultMaxPacketSize); err == nil {
+		t.Errorf("expected an error for a zero length packet")
+	}
+}
+
+func Test_Attrs_DeprecatedExtended(t *testing.T) {
+	attrs := usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_EXTENDED, Extended: []usftp.Extension{{Name: "a@b", Data: "c"}}}
+	deprecated := usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_EXTENDED, ExtendedCount: 1, ExtendedType: "a@b", ExtendedData: "c"}
+	expected, err := (&usftp.AttrsResp{Attrs: attrs}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := (&usftp.AttrsResp{Attrs: deprecated}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("got %x, expected %x", b, expected)
+	}
+}
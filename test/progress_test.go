@@ -0,0 +1,79 @@
+package test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/usftptest"
+)
+
+func Test_Progress(t *testing.T) {
+	data := strings.Repeat("0123456789", 60*1024)
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", data))
+	s := srv.Session()
+
+	var reports []usftp.Progress
+	progress := usftp.WithProgress(func(p usftp.Progress) {
+		reports = append(reports, p)
+	})
+	var stats usftp.TransferStats
+	if err := s.Get("/a", &bytes.Buffer{}, progress, usftp.WithStats(&stats)); err != nil {
+		t.Fatal(err)
+	}
+	// 600KiB in reads of 255KiB
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 reports, got %d", len(reports))
+	}
+	last := reports[len(reports)-1]
+	if last.Path != "/a" || last.Bytes != uint64(len(data)) || last.Total != uint64(len(data)) || last.ETA != 0 {
+		t.Errorf("unexpected final progress %+v", last)
+	}
+	if reports[0].Bytes != 255*1024 || reports[0].Rate <= 0 {
+		t.Errorf("unexpected first progress %+v", reports[0])
+	}
+	// stat, open, 4 reads with the last at the end of the file, close
+	if stats.Bytes != uint64(len(data)) || stats.Requests != 7 || stats.Duration <= 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	reports = nil
+	if err := s.Put(strings.NewReader(data), "/b", progress, usftp.WithStats(&stats)); err != nil {
+		t.Fatal(err)
+	}
+	last = reports[len(reports)-1]
+	if last.Path != "/b" || last.Bytes != uint64(len(data)) || last.Total != uint64(len(data)) {
+		t.Errorf("unexpected final progress %+v", last)
+	}
+	// open, 3 writes, close added to the stats of the download
+	if stats.Bytes != 2*uint64(len(data)) || stats.Requests != 12 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func Test_Progress_Resume(t *testing.T) {
+	data := strings.Repeat("0123456789", 60*1024)
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", data))
+	s := srv.Session()
+	p := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(p, []byte(data[:500*1024]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var reports []usftp.Progress
+	var stats usftp.TransferStats
+	err := s.ResumeGet("/a", p, usftp.WithStats(&stats), usftp.WithProgress(func(p usftp.Progress) {
+		reports = append(reports, p)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Bytes != uint64(len(data)) || reports[0].Total != uint64(len(data)) {
+		t.Errorf("unexpected progress %+v", reports)
+	}
+	if stats.Bytes != uint64(len(data)-500*1024) {
+		t.Errorf("expected %d bytes, got %d", len(data)-500*1024, stats.Bytes)
+	}
+}
@@ -0,0 +1,216 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/server"
+	"github.com/richardjennings/usftp/usftptest"
+)
+
+func Test_Put(t *testing.T) {
+	data := strings.Repeat("0123456789", 60*1024)
+	srv := usftptest.NewServer(t, usftptest.WithFile("/share/a", strings.Repeat("x", 700*1024)))
+	s := srv.Session()
+	for _, name := range []string{"/share/a", "/share/b"} {
+		if err := s.Put(strings.NewReader(data), name); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := s.Get(name, &b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != data {
+			t.Errorf("%s: expected %d bytes, got %d", name, len(data), b.Len())
+		}
+	}
+	err := s.Put(strings.NewReader(data), "/missing/a")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	var statusErr *usftp.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != usftp.SSH_FX_NO_SUCH_FILE {
+		t.Errorf("expected a StatusError, got %v", err)
+	}
+}
+
+func Test_ResumePut(t *testing.T) {
+	data := strings.Repeat("0123456789", 60*1024)
+	local := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(local, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := usftptest.NewServer(t, usftptest.WithFS("/share", os.DirFS(t.TempDir())))
+	s := srv.Session()
+
+	for _, partial := range []int{-1, 0, 1, 300 * 1024, len(data)} {
+		if partial >= 0 {
+			if err := s.Put(strings.NewReader(data[:partial]), "/share/a"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.ResumePut(local, "/share/a", usftp.WithVerifyOverlap(1024)); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := s.Get("/share/a", &b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != data {
+			t.Errorf("partial %d: expected %d bytes, got %d", partial, len(data), b.Len())
+		}
+	}
+
+	// the partial file differs from the source
+	if err := s.Put(strings.NewReader("x"+data[1:1000]), "/share/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResumePut(local, "/share/a", usftp.WithVerifyOverlap(-1)); !errors.Is(err, usftp.ErrResumeMismatch) {
+		t.Errorf("expected ErrResumeMismatch, got %v", err)
+	}
+	// only the last byte is compared
+	if err := s.ResumePut(local, "/share/a", usftp.WithVerifyOverlap(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the remote file is larger than the source
+	if err := s.Put(strings.NewReader(data+"x"), "/share/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ResumePut(local, "/share/a"); err == nil {
+		t.Errorf("expected an error for a larger remote file")
+	}
+}
+
+func Test_Client_ResumePut(t *testing.T) {
+	data := strings.Repeat("0123456789", 60*1024)
+	local := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(local, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := usftptest.NewServer(t)
+	c := clientHelper(t, srv)
+	srv.DropConnections()
+	if err := c.ResumePut(local, "/a"); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := c.Stat("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Size != uint64(len(data)) {
+		t.Errorf("expected size %d, got %d", len(data), attrs.Size)
+	}
+}
+
+// hookReader calls hook before the first read
+type hookReader struct {
+	io.Reader
+	hook func()
+}
+
+func (r *hookReader) Read(b []byte) (int, error) {
+	if r.hook != nil {
+		r.hook()
+		r.hook = nil
+	}
+	return r.Reader.Read(b)
+}
+
+// failReader returns err once r is exhausted
+type failReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *failReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+// renameHandler hides the PosixRename method of a Handler
+type renameHandler struct {
+	server.Handler
+}
+
+func Test_Put_Atomic(t *testing.T) {
+	for name, h := range map[string]server.Handler{"posix-rename": server.NewMemHandler(), "rename": renameHandler{server.NewMemHandler()}} {
+		t.Run(name, func(t *testing.T) {
+			srv := usftptest.NewServer(t, usftptest.WithHandler(h), usftptest.WithFile("/share/a", "old"))
+			s := srv.Session()
+			other := srv.Session()
+			r := &hookReader{Reader: strings.NewReader("new"), hook: func() {
+				var b bytes.Buffer
+				if err := other.Get("/share/a", &b); err != nil || b.String() != "old" {
+					t.Errorf("expected the old content during the upload, got %q %v", b.String(), err)
+				}
+				if _, err := other.Stat("/share/.a.part"); err != nil {
+					t.Errorf("expected the temporary file, got %v", err)
+				}
+			}}
+			if err := s.Put(r, "/share/a", usftp.WithAtomic(), usftp.WithFsync()); err != nil {
+				t.Fatal(err)
+			}
+			var b bytes.Buffer
+			if err := s.Get("/share/a", &b); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != "new" {
+				t.Errorf("expected new, got %s", b.String())
+			}
+			if _, err := s.Stat("/share/.a.part"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected the temporary file to be renamed, got %v", err)
+			}
+
+			// a failed upload leaves the destination alone and removes the temporary file
+			failed := errors.New("failed")
+			err := s.Put(&failReader{r: strings.NewReader("partial"), err: failed}, "/share/a", usftp.WithTempName("%s.tmp"))
+			if !errors.Is(err, failed) {
+				t.Errorf("expected the read error, got %v", err)
+			}
+			b.Reset()
+			if err := s.Get("/share/a", &b); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != "new" {
+				t.Errorf("expected new, got %s", b.String())
+			}
+			if _, err := s.Stat("/share/a.tmp"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("expected the temporary file to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func Test_ResumePut_Atomic(t *testing.T) {
+	data := strings.Repeat("0123456789", 60*1024)
+	local := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(local, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	srv := usftptest.NewServer(t, usftptest.WithFile("/share/.a.part", data[:1000]))
+	s := srv.Session()
+	if err := s.ResumePut(local, "/share/a", usftp.WithAtomic(), usftp.WithVerifyOverlap(-1)); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := s.Get("/share/a", &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != data {
+		t.Errorf("expected %d bytes, got %d", len(data), b.Len())
+	}
+	if _, err := s.Stat("/share/.a.part"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the temporary file to be renamed, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/usftptest"
+)
+
+func Test_RateLimit(t *testing.T) {
+	data := strings.Repeat("0123456789", 200*1024)
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", data))
+
+	// 2MB at 4MB/s, of which the first second of allowance must accumulate
+	l := usftp.NewRateLimiter(4 * 1000 * 1000)
+	s := srv.Session()
+	start := time.Now()
+	if err := s.Put(strings.NewReader(data), "/b", usftp.WithRateLimit(l)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("expected the upload to be limited, took %s", d)
+	}
+
+	limited := srv.Session(usftp.WithSessionRateLimit(usftp.NewRateLimiter(4 * 1000 * 1000)))
+	start = time.Now()
+	if err := limited.Get("/a", &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Errorf("expected the download to be limited, took %s", d)
+	}
+}
+
+func Test_RateLimit_SetLimit(t *testing.T) {
+	data := strings.Repeat("0123456789", 200*1024)
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", data))
+	s := srv.Session()
+
+	// slow enough to take minutes unless the limit is lifted
+	l := usftp.NewRateLimiter(10 * 1000)
+	if l.Limit() != 10*1000 {
+		t.Errorf("expected 10000, got %d", l.Limit())
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l.SetLimit(0)
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Get("/a", &bytes.Buffer{}, usftp.WithRateLimit(l))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the limit was not lifted")
+	}
+}
@@ -0,0 +1,319 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/server"
+)
+
+// mapHandler serves read only files from a map, the remaining Handler methods are not used
+type mapHandler struct {
+	server.Handler
+	files map[string]string
+}
+
+type mapFile struct {
+	*bytes.Reader
+	server.File
+}
+
+func (h *mapHandler) Open(name string, _ uint32, _ usftp.Attrs) (server.File, error) {
+	if v, ok := h.files[name]; ok {
+		return &mapFile{Reader: bytes.NewReader([]byte(v))}, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (f *mapFile) ReadAt(b []byte, off int64) (int, error) {
+	return f.Reader.ReadAt(b, off)
+}
+
+func (f *mapFile) Close() error {
+	return nil
+}
+
+func (h *mapHandler) ReadDir(name string) ([]*usftp.NameRespFile, error) {
+	if name != "/" {
+		return nil, fs.ErrNotExist
+	}
+	var names []*usftp.NameRespFile
+	for k, v := range h.files {
+		names = append(names, &usftp.NameRespFile{Filename: k[1:], Attrs: usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_SIZE, Size: uint64(len(v))}})
+	}
+	return names, nil
+}
+
+func (h *mapHandler) Stat(name string) (usftp.Attrs, error) {
+	if name == "/" {
+		return usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_PERMISSIONS, Permissions: usftp.ModeDir | 0755}, nil
+	}
+	if v, ok := h.files[name]; ok {
+		return usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_SIZE, Size: uint64(len(v))}, nil
+	}
+	return usftp.Attrs{}, fs.ErrNotExist
+}
+
+func pipeHelper(t *testing.T) net.Conn {
+	c, sc := net.Pipe()
+	s := server.New(&mapHandler{files: map[string]string{"/a.txt": "hello"}})
+	go func() { _ = s.Serve(sc) }()
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func roundTrip(t *testing.T, c net.Conn, req usftp.Msg) usftp.Msg {
+	if err := usftp.WriteMsg(c, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := usftp.ReadMsg(c, usftp.DefaultMaxPacketSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func Test_Server_Read(t *testing.T) {
+	c := pipeHelper(t)
+	if resp, ok := roundTrip(t, c, &usftp.InitReq{Version: 3}).(*usftp.VersionResp); !ok || resp.Version != 3 {
+		t.Fatalf("got %+v, expected version 3", resp)
+	}
+	handle, ok := roundTrip(t, c, &usftp.OpenReq{Header: usftp.Header{Id: 1}, Filename: "a.txt", Pflags: usftp.SSH_FXF_READ}).(*usftp.HandleResp)
+	if !ok {
+		t.Fatalf("expected a HandleResp")
+	}
+	data, ok := roundTrip(t, c, &usftp.ReadReq{Header: usftp.Header{Id: 2}, Handle: handle.Handle, Len: 1024}).(*usftp.DataResp)
+	if !ok {
+		t.Fatalf("expected a DataResp")
+	}
+	if string(data.Data) != "hello" {
+		t.Errorf("got %q, expected %q", data.Data, "hello")
+	}
+	eof, ok := roundTrip(t, c, &usftp.ReadReq{Header: usftp.Header{Id: 3}, Handle: handle.Handle, Offset: 5, Len: 1024}).(*usftp.StatusResp)
+	if !ok || eof.ErrorCode != usftp.SSH_FX_EOF {
+		t.Errorf("got %+v, expected SSH_FX_EOF", eof)
+	}
+	closed, ok := roundTrip(t, c, &usftp.CloseReq{Header: usftp.Header{Id: 4}, Handle: handle.Handle}).(*usftp.StatusResp)
+	if !ok || closed.ErrorCode != usftp.SSH_FX_OK || closed.Id != 4 {
+		t.Errorf("got %+v, expected SSH_FX_OK", closed)
+	}
+}
+
+func Test_Server_ReadDir(t *testing.T) {
+	c := pipeHelper(t)
+	roundTrip(t, c, &usftp.InitReq{Version: 3})
+	handle, ok := roundTrip(t, c, &usftp.OpenDirReq{Header: usftp.Header{Id: 1}, Path: "/"}).(*usftp.HandleResp)
+	if !ok {
+		t.Fatalf("expected a HandleResp")
+	}
+	names, ok := roundTrip(t, c, &usftp.ReadDirReq{Header: usftp.Header{Id: 2}, Handle: handle.Handle}).(*usftp.NameResp)
+	if !ok {
+		t.Fatalf("expected a NameResp")
+	}
+	if len(names.Names) != 3 {
+		t.Fatalf("got %d names, expected %d", len(names.Names), 3)
+	}
+	if names.Names[0].Filename != "." || names.Names[2].Filename != "a.txt" {
+		t.Errorf("got %q and %q, expected %q and %q", names.Names[0].Filename, names.Names[2].Filename, ".", "a.txt")
+	}
+	eof, ok := roundTrip(t, c, &usftp.ReadDirReq{Header: usftp.Header{Id: 3}, Handle: handle.Handle}).(*usftp.StatusResp)
+	if !ok || eof.ErrorCode != usftp.SSH_FX_EOF {
+		t.Errorf("got %+v, expected SSH_FX_EOF", eof)
+	}
+}
+
+func Test_Server_Status(t *testing.T) {
+	c := pipeHelper(t)
+	roundTrip(t, c, &usftp.InitReq{Version: 3})
+	resp, ok := roundTrip(t, c, &usftp.StatReq{Header: usftp.Header{Id: 1}, Path: "/missing"}).(*usftp.StatusResp)
+	if !ok || resp.ErrorCode != usftp.SSH_FX_NO_SUCH_FILE {
+		t.Errorf("got %+v, expected SSH_FX_NO_SUCH_FILE", resp)
+	}
+	resp, ok = roundTrip(t, c, &usftp.ExtendedReq{Header: usftp.Header{Id: 2}, Request: "unknown@example.com"}).(*usftp.StatusResp)
+	if !ok || resp.ErrorCode != usftp.SSH_FX_OP_UNSUPPORTED {
+		t.Errorf("got %+v, expected SSH_FX_OP_UNSUPPORTED", resp)
+	}
+	attrs, ok := roundTrip(t, c, &usftp.StatReq{Header: usftp.Header{Id: 3}, Path: "/x/../a.txt"}).(*usftp.AttrsResp)
+	if !ok || attrs.Attrs.Size != 5 {
+		t.Errorf("got %+v, expected size 5", attrs)
+	}
+}
+
+func Test_Server_MaxFileSize(t *testing.T) {
+	c, sc := net.Pipe()
+	s := server.New(server.NewMemHandler(server.WithMaxFileSize(1 << 20)))
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(sc) }()
+	t.Cleanup(func() { _ = c.Close() })
+	roundTrip(t, c, &usftp.InitReq{Version: 3})
+	handle, ok := roundTrip(t, c, &usftp.OpenReq{Header: usftp.Header{Id: 1}, Filename: "/a", Pflags: usftp.SSH_FXF_WRITE | usftp.SSH_FXF_CREAT}).(*usftp.HandleResp)
+	if !ok {
+		t.Fatalf("expected a HandleResp")
+	}
+	for i, offset := range []uint64{1 << 50, 1 << 33, 1 << 20} {
+		resp, ok := roundTrip(t, c, &usftp.WriteReq{Header: usftp.Header{Id: uint32(2 + i)}, Handle: handle.Handle, Offset: offset, Data: []byte("x")}).(*usftp.StatusResp)
+		if !ok || resp.ErrorCode != usftp.SSH_FX_FAILURE {
+			t.Errorf("offset %d: got %+v, expected SSH_FX_FAILURE", offset, resp)
+		}
+	}
+	resp, ok := roundTrip(t, c, &usftp.SetstatReq{Header: usftp.Header{Id: 5}, Path: "/a", Attrs: usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_SIZE, Size: 1 << 50}}).(*usftp.StatusResp)
+	if !ok || resp.ErrorCode != usftp.SSH_FX_FAILURE {
+		t.Errorf("got %+v, expected SSH_FX_FAILURE", resp)
+	}
+	resp, ok = roundTrip(t, c, &usftp.WriteReq{Header: usftp.Header{Id: 6}, Handle: handle.Handle, Offset: 1<<20 - 1, Data: []byte("x")}).(*usftp.StatusResp)
+	if !ok || resp.ErrorCode != usftp.SSH_FX_OK {
+		t.Errorf("got %+v, expected SSH_FX_OK", resp)
+	}
+	_ = c.Close()
+	if err := <-done; err != nil {
+		t.Errorf("expected Serve to end cleanly, got %v", err)
+	}
+}
+
+func Test_Server_MaxPacketSize(t *testing.T) {
+	c, sc := net.Pipe()
+	// raised to the minimum packet size, the data returned must still fit
+	s := server.New(&mapHandler{files: map[string]string{"/a.txt": strings.Repeat("a", 100<<10)}}, server.WithMaxPacketSize(100))
+	go func() { _ = s.Serve(sc) }()
+	t.Cleanup(func() { _ = c.Close() })
+	roundTrip(t, c, &usftp.InitReq{Version: 3})
+	handle, ok := roundTrip(t, c, &usftp.OpenReq{Header: usftp.Header{Id: 1}, Filename: "/a.txt", Pflags: usftp.SSH_FXF_READ}).(*usftp.HandleResp)
+	if !ok {
+		t.Fatalf("expected a HandleResp")
+	}
+	if err := usftp.WriteMsg(c, &usftp.ReadReq{Header: usftp.Header{Id: 2}, Handle: handle.Handle, Len: 64 << 10}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := usftp.ReadMsg(c, 34000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := resp.(*usftp.DataResp); !ok || len(data.Data) == 0 {
+		t.Errorf("got %+v, expected a DataResp", resp)
+	}
+}
+
+func Test_Server_UndecodedRequest(t *testing.T) {
+	c, sc := net.Pipe()
+	s := server.New(&mapHandler{files: map[string]string{"/a.txt": "hello"}})
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(sc) }()
+	t.Cleanup(func() { _ = c.Close() })
+	roundTrip(t, c, &usftp.InitReq{Version: 3})
+	raw := func(typ uint8, payload ...byte) {
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+		if _, err := c.Write(append(append(b, typ), payload...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tcs := []struct {
+		typ     uint8
+		payload []byte
+		code    uint32
+	}{
+		// an unknown type
+		{250, []byte{0, 0, 0, 7, 1, 2}, usftp.SSH_FX_OP_UNSUPPORTED},
+		// the filename runs past the end of the payload
+		{usftp.SSH_FXP_OPEN, []byte{0, 0, 0, 7, 0, 0, 1, 0, 'a'}, usftp.SSH_FX_BAD_MESSAGE},
+	}
+	for _, tc := range tcs {
+		raw(tc.typ, tc.payload...)
+		resp, err := usftp.ReadMsg(c, usftp.DefaultMaxPacketSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, ok := resp.(*usftp.StatusResp); !ok || status.Id != 7 || status.ErrorCode != tc.code {
+			t.Errorf("type %d: got %+v, expected status %d for id 7", tc.typ, resp, tc.code)
+		}
+	}
+	// the connection is still in sync
+	if _, ok := roundTrip(t, c, &usftp.StatReq{Header: usftp.Header{Id: 8}, Path: "/a.txt"}).(*usftp.AttrsResp); !ok {
+		t.Errorf("expected an AttrsResp")
+	}
+	// without a request id there is nothing to answer
+	raw(usftp.SSH_FXP_OPEN, 0, 0)
+	if err := <-done; !errors.Is(err, usftp.ErrMalformedPacket) {
+		t.Errorf("got %v, expected %v", err, usftp.ErrMalformedPacket)
+	}
+}
+
+func Test_Server_MaxHandles(t *testing.T) {
+	c, sc := net.Pipe()
+	s := server.New(&mapHandler{files: map[string]string{"/a.txt": "hello"}}, server.WithMaxHandles(2))
+	go func() { _ = s.Serve(sc) }()
+	t.Cleanup(func() { _ = c.Close() })
+	roundTrip(t, c, &usftp.InitReq{Version: 3})
+	var handles []string
+	for i := uint32(1); i <= 2; i++ {
+		handle, ok := roundTrip(t, c, &usftp.OpenReq{Header: usftp.Header{Id: i}, Filename: "/a.txt", Pflags: usftp.SSH_FXF_READ}).(*usftp.HandleResp)
+		if !ok {
+			t.Fatalf("expected a HandleResp")
+		}
+		handles = append(handles, handle.Handle)
+	}
+	for _, req := range []usftp.Msg{
+		&usftp.OpenReq{Header: usftp.Header{Id: 3}, Filename: "/a.txt", Pflags: usftp.SSH_FXF_READ},
+		&usftp.OpenDirReq{Header: usftp.Header{Id: 3}, Path: "/"},
+	} {
+		if resp, ok := roundTrip(t, c, req).(*usftp.StatusResp); !ok || resp.ErrorCode != usftp.SSH_FX_FAILURE {
+			t.Errorf("got %+v, expected SSH_FX_FAILURE", resp)
+		}
+	}
+	roundTrip(t, c, &usftp.CloseReq{Header: usftp.Header{Id: 4}, Handle: handles[0]})
+	if _, ok := roundTrip(t, c, &usftp.OpenDirReq{Header: usftp.Header{Id: 5}, Path: "/"}).(*usftp.HandleResp); !ok {
+		t.Errorf("expected a HandleResp once a handle is closed")
+	}
+}
+
+func Test_Server_ReadDir_Batches(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 250; i++ {
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprint(i)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err := server.NewLocalHandler(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, sc := net.Pipe()
+	go func() { _ = server.New(h).Serve(sc) }()
+	t.Cleanup(func() { _ = c.Close() })
+	roundTrip(t, c, &usftp.InitReq{Version: 3})
+	handle, ok := roundTrip(t, c, &usftp.OpenDirReq{Header: usftp.Header{Id: 1}, Path: "/"}).(*usftp.HandleResp)
+	if !ok {
+		t.Fatalf("expected a HandleResp")
+	}
+	seen := map[string]bool{}
+	for id := uint32(2); ; id++ {
+		resp := roundTrip(t, c, &usftp.ReadDirReq{Header: usftp.Header{Id: id}, Handle: handle.Handle})
+		if status, ok := resp.(*usftp.StatusResp); ok {
+			if status.ErrorCode != usftp.SSH_FX_EOF {
+				t.Fatalf("got %+v, expected SSH_FX_EOF", status)
+			}
+			break
+		}
+		names, ok := resp.(*usftp.NameResp)
+		if !ok || len(names.Names) == 0 || len(names.Names) > 100 {
+			t.Fatalf("got %+v, expected a NameResp of at most 100 names", resp)
+		}
+		for _, n := range names.Names {
+			if seen[n.Filename] {
+				t.Errorf("%s listed twice", n.Filename)
+			}
+			seen[n.Filename] = true
+		}
+	}
+	if len(seen) != 252 {
+		t.Errorf("got %d names, expected 252", len(seen))
+	}
+}
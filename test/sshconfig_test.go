@@ -0,0 +1,248 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/usftptest"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func Test_ResolveHost(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := filepath.Join(home, ".ssh")
+	if err := os.MkdirAll(filepath.Join(dir, "conf.d"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := `# comment
+Include conf.d/*.conf
+
+Host web web.example.com
+	HostName 10.0.0.1
+	User = deploy
+	IdentityFile ~/.ssh/id_web
+	IdentityFile "/keys/%r@%h"
+
+Host *.internal !skip.internal
+	ProxyJump admin@bastion:2222,other
+	UserKnownHostsFile ~/.ssh/internal_hosts /etc/ssh/internal_hosts
+
+Match host web
+	User ignored
+
+Host *
+	User everyone
+	Port 2022
+`
+	if err := os.WriteFile(filepath.Join(dir, "config"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	included := "Host web\n\tPort 2200\n"
+	if err := os.WriteFile(filepath.Join(dir, "conf.d", "web.conf"), []byte(included), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "config")
+
+	tcs := []struct {
+		alias    string
+		expected usftp.HostConfig
+	}{
+		{
+			alias: "web",
+			expected: usftp.HostConfig{
+				Alias:               "web",
+				HostName:            "10.0.0.1",
+				User:                "deploy",
+				Port:                2200,
+				IdentityFiles:       []string{filepath.Join(home, ".ssh", "id_web"), "/keys/deploy@10.0.0.1"},
+				UserKnownHostsFiles: []string{filepath.Join(home, ".ssh", "known_hosts"), filepath.Join(home, ".ssh", "known_hosts2")},
+			},
+		},
+		{
+			alias: "db.internal",
+			expected: usftp.HostConfig{
+				Alias:               "db.internal",
+				HostName:            "db.internal",
+				User:                "everyone",
+				Port:                2022,
+				IdentityFiles:       []string{filepath.Join(home, ".ssh", "id_rsa"), filepath.Join(home, ".ssh", "id_ecdsa"), filepath.Join(home, ".ssh", "id_ed25519")},
+				ProxyJump:           []string{"admin@bastion:2222", "other"},
+				UserKnownHostsFiles: []string{filepath.Join(home, ".ssh", "internal_hosts"), "/etc/ssh/internal_hosts"},
+			},
+		},
+		{
+			alias: "skip.internal",
+			expected: usftp.HostConfig{
+				Alias:               "skip.internal",
+				HostName:            "skip.internal",
+				User:                "everyone",
+				Port:                2022,
+				IdentityFiles:       []string{filepath.Join(home, ".ssh", "id_rsa"), filepath.Join(home, ".ssh", "id_ecdsa"), filepath.Join(home, ".ssh", "id_ed25519")},
+				UserKnownHostsFiles: []string{filepath.Join(home, ".ssh", "known_hosts"), filepath.Join(home, ".ssh", "known_hosts2")},
+			},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.alias, func(t *testing.T) {
+			hc, err := usftp.ResolveHost(tc.alias, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(hc, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, hc)
+			}
+		})
+	}
+
+	// a missing file given explicitly is an error
+	if _, err := usftp.ResolveHost("web", filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error for a missing config file")
+	}
+	// a bad port
+	bad := filepath.Join(dir, "bad")
+	if err := os.WriteFile(bad, []byte("Port abc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := usftp.ResolveHost("web", bad); err == nil {
+		t.Errorf("expected an error for an invalid port")
+	}
+}
+
+func Test_DialHost(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	jump := usftptest.NewServer(t, usftptest.WithForwarding(), usftptest.WithUser("bastion"))
+	srv := usftptest.NewServer(t, usftptest.WithFile("/a", "a"))
+
+	knownHosts := filepath.Join(home, "known_hosts")
+	hosts := knownhosts.Line([]string{knownhosts.Normalize(jump.Addr)}, jump.HostKey.PublicKey()) + "\n" +
+		knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, srv.HostKey.PublicKey()) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(hosts), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf(`Host jump
+	HostName %s
+	Port %d
+	User %s
+	IdentityFile %s
+
+Host target
+	HostName %s
+	Port %d
+	User %s
+	IdentityFile %s
+	ProxyJump jump
+
+Host *
+	UserKnownHostsFile %s
+`, jump.Host, jump.Port, jump.User, jump.ClientKeyFile(), srv.Host, srv.Port, srv.User, srv.ClientKeyFile(), knownHosts)
+	file := filepath.Join(home, "config")
+	if err := os.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := usftp.DialHost("target", usftp.WithConfigFiles(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := usftp.NewSession(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Close() }()
+	var b bytes.Buffer
+	if err := s.Get("/a", &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "a" {
+		t.Errorf("expected a, got %s", b.String())
+	}
+}
+
+func Test_DialHost_NoKnownHosts(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	srv := usftptest.NewServer(t)
+	// the default file lists the host, but is not consulted
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr)}, srv.HostKey.PublicKey()) + "\n"
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf("Host target\n\tHostName %s\n\tPort %d\n\tUser %s\n\tIdentityFile %s\n\tUserKnownHostsFile none\n",
+		srv.Host, srv.Port, srv.User, srv.ClientKeyFile())
+	file := filepath.Join(home, "config")
+	if err := os.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hc, err := usftp.ResolveHost("target", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hc.UserKnownHostsFiles, []string{"none"}) {
+		t.Errorf("expected none, got %v", hc.UserKnownHostsFiles)
+	}
+	if _, err := usftp.DialHost("target", usftp.WithConfigFiles(file)); err == nil {
+		t.Errorf("expected an unknown host error")
+	}
+	c, err := usftp.DialHost("target", usftp.WithConfigFiles(file), usftp.WithTrustOnFirstUse(filepath.Join(home, "tofu")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+}
+
+func Test_DialHost_JumpChain(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	jump := usftptest.NewServer(t, usftptest.WithForwarding(), usftptest.WithUser("bastion"))
+	srv := usftptest.NewServer(t)
+	// the first jump host is reached through its own ProxyJump, which is unreachable
+	config := fmt.Sprintf(`Host target
+	HostName %s
+	Port %d
+	User %s
+	IdentityFile %s
+	ProxyJump jump
+
+Host jump
+	HostName %s
+	Port %d
+	User %s
+	IdentityFile %s
+	ProxyJump broken
+
+Host broken
+	HostName 127.0.0.1
+	Port 1
+
+Host *
+	UserKnownHostsFile none
+`, srv.Host, srv.Port, srv.User, srv.ClientKeyFile(), jump.Host, jump.Port, jump.User, jump.ClientKeyFile())
+	file := filepath.Join(home, "config")
+	if err := os.WriteFile(file, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := usftp.DialHost("target", usftp.WithConfigFiles(file), usftp.WithInsecureIgnoreHostKey())
+	if err == nil || !strings.Contains(err.Error(), "jump host 127.0.0.1") {
+		t.Errorf("expected an error from the jump host broken, got %v", err)
+	}
+
+	// a loop
+	loop := "Host a\n\tProxyJump b\nHost b\n\tProxyJump a\n"
+	if err := os.WriteFile(file, []byte(loop), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := usftp.DialHost("a", usftp.WithConfigFiles(file)); err == nil || !strings.Contains(err.Error(), "too many") {
+		t.Errorf("expected a nested jump host error, got %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/server"
+	"github.com/richardjennings/usftp/usftptest"
+)
+
+// writeLocal writes files below dir with the modification time mtime
+func writeLocal(t *testing.T, dir string, files map[string]string, mtime time.Time) {
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_SyncDownload(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := server.NewMemHandler()
+	attrs := usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_ACMODTIME, Atime: uint32(mtime.Unix()), Mtime: uint32(mtime.Unix())}
+	for name, data := range map[string]string{"/r/same": "same", "/r/size": "remote", "/r/time": "time", "/r/new/a": "a", "/r/skip.tmp": "x"} {
+		if err := h.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Setstat(name, attrs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := usftptest.NewServer(t, usftptest.WithHandler(h))
+	s := srv.Session()
+	dir := t.TempDir()
+	writeLocal(t, dir, map[string]string{"same": "same", "size": "local", "old/b": "b", "keep.tmp": "y"}, mtime)
+	writeLocal(t, dir, map[string]string{"time": "TIME"}, mtime.Add(time.Hour))
+
+	expected := usftp.SyncPlan{
+		{Action: usftp.SyncDelete, Path: "old/b"},
+		{Action: usftp.SyncDelete, Path: "old", Dir: true},
+		{Action: usftp.SyncMkdir, Path: "new", Dir: true},
+		{Action: usftp.SyncCopy, Path: "new/a", Size: 1},
+		{Action: usftp.SyncCopy, Path: "size", Size: 6},
+		{Action: usftp.SyncCopy, Path: "time", Size: 4},
+	}
+	opts := []usftp.TransferOption{usftp.WithDelete(), usftp.WithExclude("*.tmp")}
+	plan, err := s.SyncDownload("/r", dir, append(opts, usftp.WithDryRun())...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("expected %v, got %v", expected, plan)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old", "b")); err != nil {
+		t.Errorf("expected a dry run to leave old/b, got %v", err)
+	}
+
+	plan, err = s.SyncDownload("/r", dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("expected %v, got %v", expected, plan)
+	}
+	for name, data := range map[string]string{"same": "same", "size": "remote", "time": "time", "new/a": "a", "keep.tmp": "y"} {
+		b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Errorf("%s: expected %s, got %s", name, data, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected old to be deleted, got %v", err)
+	}
+	if plan, err := s.SyncDownload("/r", dir, opts...); err != nil || len(plan) != 0 {
+		t.Errorf("expected nothing to do, got %v %v", plan, err)
+	}
+
+	// a file replacing a directory requires WithDelete
+	if err := os.Remove(filepath.Join(dir, "same")); err != nil {
+		t.Fatal(err)
+	}
+	writeLocal(t, dir, map[string]string{"same/c": "c"}, mtime)
+	if _, err := s.SyncDownload("/r", dir); err == nil {
+		t.Errorf("expected a conflict error")
+	}
+	if _, err := s.SyncDownload("/r", dir, opts...); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "same")); err != nil || string(b) != "same" {
+		t.Errorf("expected same to replace the directory, got %s %v", b, err)
+	}
+}
+
+func Test_SyncDownload_Relative(t *testing.T) {
+	h := server.NewMemHandler()
+	if err := h.MkdirAll("/r/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"/r/a": "a", "/r/sub/b": "b"}
+	for name, data := range files {
+		if err := h.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := usftptest.NewServer(t, usftptest.WithHandler(h))
+	s := srv.Session()
+	dir := t.TempDir()
+	t.Chdir(dir)
+	// top level files are bare filenames, their temporary files must not go to TMPDIR
+	t.Setenv("TMPDIR", filepath.Join(dir, "missing"))
+
+	plan, err := s.SyncDownload("/r", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 3 {
+		t.Errorf("expected 3 changes, got %v", plan)
+	}
+	for name, data := range map[string]string{"a": "a", "sub/b": "b"} {
+		b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || string(b) != data {
+			t.Errorf("%s: expected %q, got %q %v", name, data, b, err)
+		}
+	}
+	if plan, err := s.SyncDownload("/r", "."); err != nil || len(plan) != 0 {
+		t.Errorf("expected nothing to do, got %v %v", plan, err)
+	}
+}
+
+func Test_SyncUpload(t *testing.T) {
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dir := t.TempDir()
+	writeLocal(t, dir, map[string]string{"a": "aaaa", "sub/b": "bbbb"}, mtime)
+	srv := usftptest.NewServer(t, usftptest.WithHandler(server.NewMemHandler()))
+	s := srv.Session()
+
+	plan, err := s.SyncUpload(dir, "/r/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := usftp.SyncPlan{
+		{Action: usftp.SyncMkdir, Path: ".", Dir: true},
+		{Action: usftp.SyncCopy, Path: "a", Size: 4},
+		{Action: usftp.SyncMkdir, Path: "sub", Dir: true},
+		{Action: usftp.SyncCopy, Path: "sub/b", Size: 4},
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("expected %v, got %v", expected, plan)
+	}
+	if plan.Bytes() != 8 {
+		t.Errorf("expected 8 bytes, got %d", plan.Bytes())
+	}
+
+	// the same content with a new time is unchanged by checksum, a new content of the same size
+	// and time is not
+	writeLocal(t, dir, map[string]string{"a": "aaaa"}, mtime.Add(time.Hour))
+	writeLocal(t, dir, map[string]string{"sub/b": "BBBB"}, mtime)
+	if plan, err := s.SyncUpload(dir, "/r/d", usftp.WithDryRun()); err != nil || len(plan) != 1 || plan[0].Path != "a" {
+		t.Errorf("expected a to be copied by time, got %v %v", plan, err)
+	}
+	plan, err = s.SyncUpload(dir, "/r/d", usftp.WithChecksum())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 1 || plan[0].Path != "sub/b" {
+		t.Errorf("expected sub/b to be copied by checksum, got %v", plan)
+	}
+	var b bytes.Buffer
+	if err := s.Get("/r/d/sub/b", &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "BBBB" {
+		t.Errorf("expected BBBB, got %s", b.String())
+	}
+
+	// extraneous remote files are kept without WithDelete
+	if err := os.RemoveAll(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SyncUpload(dir, "/r/d"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("/r/d/sub/b"); err != nil {
+		t.Errorf("expected sub/b to be kept, got %v", err)
+	}
+	if _, err := s.SyncUpload(dir, "/r/d", usftp.WithDelete()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("/r/d/sub"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected sub to be deleted, got %v", err)
+	}
+	if _, err := s.SyncUpload(filepath.Join(dir, "missing"), "/r/d"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+}
@@ -2,13 +2,20 @@ package test
 
 import (
 	"bytes"
-	"github.com/richardjennings/usftp"
-	"golang.org/x/crypto/ssh"
+	"os"
 	"testing"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/usftptest"
 )
 
+func serverHelper(t *testing.T) *usftptest.Server {
+	return usftptest.NewServer(t, usftptest.WithFS("/share", os.DirFS("share")))
+}
+
 func Test_Connection(t *testing.T) {
-	c, err := usftp.Dial("foo", "127.0.0.1", 2222, "./ssh_key", nil)
+	srv := serverHelper(t)
+	c, err := usftp.Dial(srv.User, srv.Host, srv.Port, srv.ClientKeyFile(), srv.HostKeyCallback())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -20,22 +27,8 @@ func Test_Connection(t *testing.T) {
 	defer func() { _ = s.Close() }()
 }
 
-func clientHelper(t *testing.T) *ssh.Client {
-	c, err := usftp.Dial("foo", "127.0.0.1", 2222, "./ssh_key", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	return c
-}
-
 func Test_Ls(t *testing.T) {
-	c := clientHelper(t)
-	defer func() { _ = c.Close() }()
-	s, err := usftp.NewSession(c)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer func() { _ = s.Close() }()
+	s := serverHelper(t).Session()
 	names, err := s.Ls("/share")
 	if err != nil {
 		t.Fatal(err)
@@ -73,13 +66,7 @@ func Test_Ls(t *testing.T) {
 }
 
 func Test_Get(t *testing.T) {
-	c := clientHelper(t)
-	defer func() { _ = c.Close() }()
-	s, err := usftp.NewSession(c)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer func() { _ = s.Close() }()
+	s := serverHelper(t).Session()
 
 	w := bytes.NewBuffer(nil)
 	if err := s.Get("/share/file1.txt", w); err != nil {
@@ -91,13 +78,7 @@ func Test_Get(t *testing.T) {
 }
 
 func Test_Find(t *testing.T) {
-	c := clientHelper(t)
-	defer func() { _ = c.Close() }()
-	s, err := usftp.NewSession(c)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer func() { _ = s.Close() }()
+	s := serverHelper(t).Session()
 	files, err := s.Find("/share")
 	if err != nil {
 		t.Fatal(err)
@@ -123,13 +104,7 @@ func Test_Find(t *testing.T) {
 }
 
 func Test_Walk_UnseenFileVisitor(t *testing.T) {
-	c := clientHelper(t)
-	defer func() { _ = c.Close() }()
-	s, err := usftp.NewSession(c)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer func() { _ = s.Close() }()
+	s := serverHelper(t).Session()
 	seen := map[string]*usftp.NameRespFile{
 		"/share/file1.txt":     {Attrs: usftp.Attrs{Size: 1}},
 		"/share/dir/file2.txt": {Attrs: usftp.Attrs{Size: 1}},
@@ -0,0 +1,360 @@
+package usftp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+)
+
+// maxDataLength is how much to read or write with one request, leaving room for the rest of the
+// packet within the limit OpenSSH applies
+//
+// https://github.com/openssh/openssh-portable/blob/master/sftp-common.h#L29
+// /* Maximum packet that we are willing to send/accept */
+//
+//	#define SFTP_MAX_MSG_LENGTH	(256 * 1024)
+const maxDataLength = 255 * 1024
+
+// dataOverhead is the size of an SSH_FXP_DATA packet besides its data: the length, type, id and
+// data length
+const dataOverhead = 13
+
+const (
+	extPosixRename = "posix-rename@openssh.com"
+	extFsync       = "fsync@openssh.com"
+
+	// DefaultTempName is the name an atomic upload is written to before being renamed, with %s
+	// replaced by the name of the destination
+	DefaultTempName = ".%s.part"
+)
+
+// ErrResumeMismatch is returned when resuming a transfer and the content already transferred
+// does not match the source
+var ErrResumeMismatch = errors.New("partial file does not match source")
+
+type (
+	// TransferOption configures an upload or download
+	TransferOption func(*transferOptions)
+
+	transferOptions struct {
+		verify   int64
+		tempName string
+		fsync    bool
+		progress func(Progress)
+		stats    *TransferStats
+		limiter  *RateLimiter
+
+		overwrite     OverwritePolicy
+		skipUnchanged bool
+
+		concurrency int
+		include     []string
+		exclude     []string
+
+		delete   bool
+		dryRun   bool
+		checksum bool
+		// shared serialises progress and stats between the concurrent transfers of a directory
+		shared *sync.Mutex
+	}
+)
+
+// WithVerifyOverlap compares a SHA-256 checksum of the last n bytes already transferred with
+// the source before resuming, failing with ErrResumeMismatch when they differ. A negative n
+// compares everything already transferred.
+func WithVerifyOverlap(n int64) TransferOption {
+	return func(o *transferOptions) {
+		o.verify = n
+	}
+}
+
+// WithAtomic writes an upload to a temporary name in the same directory, DefaultTempName, and
+// renames it into place only once complete, so the destination never holds a partial file. The
+// temporary file is removed when the upload fails, other than by ResumePut which continues from
+// it. The destination is replaced atomically when the server supports posix-rename@openssh.com,
+// otherwise it is removed before the rename.
+func WithAtomic() TransferOption {
+	return WithTempName(DefaultTempName)
+}
+
+// WithTempName is WithAtomic using the temporary name format, in which %s is replaced by the
+// name of the destination
+func WithTempName(format string) TransferOption {
+	return func(o *transferOptions) {
+		o.tempName = format
+	}
+}
+
+// WithFsync asks the server to flush an upload to stable storage before it is closed, failing
+// with errors.ErrUnsupported when the server does not support fsync@openssh.com
+func WithFsync() TransferOption {
+	return func(o *transferOptions) {
+		o.fsync = true
+	}
+}
+
+func newTransferOptions(opts []TransferOption) transferOptions {
+	o := transferOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Put writes the contents of r to the file to, creating it or truncating an existing file
+func (s *Session) Put(r io.Reader, to string, opts ...TransferOption) error {
+	t := newTransfer(to, newTransferOptions(opts))
+	defer t.finish()
+	t.total = readerSize(r)
+	return s.upload(r, to, t)
+}
+
+// upload writes the contents of r to the file to, through a temporary file when atomic
+func (s *Session) upload(r io.Reader, to string, t *transfer) error {
+	if t.tempName == "" {
+		_, err := s.put(r, to, 0, SSH_FXF_WRITE|SSH_FXF_CREAT|SSH_FXF_TRUNC, t)
+		return err
+	}
+	tmp := tempPath(to, t.tempName)
+	if _, err := s.put(r, tmp, 0, SSH_FXF_WRITE|SSH_FXF_CREAT|SSH_FXF_TRUNC, t); err != nil {
+		_ = s.Remove(tmp)
+		return err
+	}
+	if err := s.replace(tmp, to, t); err != nil {
+		_ = s.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ResumePut uploads the local file localPath to remote, continuing after any content already in
+// remote from an earlier interrupted upload. The remote file must not be larger than localPath,
+// and is checked to have the size of localPath when complete. With WithAtomic the temporary
+// file is resumed, and kept when the upload fails.
+func (s *Session) ResumePut(localPath string, remote string, opts ...TransferOption) error {
+	t := newTransfer(remote, newTransferOptions(opts))
+	defer t.finish()
+	to := remote
+	if t.tempName != "" {
+		to = tempPath(remote, t.tempName)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(fi.Size())
+	t.request()
+	offset, err := s.remoteSize(to)
+	if err != nil {
+		return err
+	}
+	if offset > size {
+		return fmt.Errorf("%s: remote size %d is larger than local size %d", to, offset, size)
+	}
+	if t.verify != 0 && offset > 0 {
+		if err := s.verifyOverlap(f, to, offset, t); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	t.offset, t.total = offset, size
+	if _, err := s.put(f, to, offset, SSH_FXF_WRITE|SSH_FXF_CREAT, t); err != nil {
+		return err
+	}
+	t.request()
+	written, err := s.remoteSize(to)
+	if err != nil {
+		return err
+	}
+	if written != size {
+		return fmt.Errorf("%s: uploaded %d of %d bytes", to, written, size)
+	}
+	if to != remote {
+		return s.replace(to, remote, t)
+	}
+	return nil
+}
+
+// tempPath returns the temporary name for to in the same directory
+func tempPath(to string, format string) string {
+	return path.Join(path.Dir(to), fmt.Sprintf(format, path.Base(to)))
+}
+
+// replace renames tmp to to, atomically when the server supports posix-rename
+func (s *Session) replace(tmp string, to string, t *transfer) error {
+	t.request()
+	if s.hasExtension(extPosixRename) {
+		return s.PosixRename(tmp, to)
+	}
+	if err := s.Remove(to); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	t.request()
+	return s.Rename(tmp, to)
+}
+
+// remoteSize returns the size of path, or 0 when it does not exist
+func (s *Session) remoteSize(path string) (uint64, error) {
+	attrs, err := s.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if attrs.Flags&SSH_FILEXFER_ATTR_SIZE == 0 {
+		return 0, fmt.Errorf("%s: size unknown, can not resume", path)
+	}
+	return attrs.Size, nil
+}
+
+// verifyOverlap compares the t.verify bytes of remote before offset with the same range of f
+func (s *Session) verifyOverlap(f io.ReaderAt, remote string, offset uint64, t *transfer) error {
+	n := t.verify
+	if n < 0 || uint64(n) > offset {
+		n = int64(offset)
+	}
+	start := offset - uint64(n)
+	remoteHash := sha256.New()
+	// counted as requests of the transfer, but not as bytes transferred
+	check := newTransfer(remote, transferOptions{})
+	_, err := s.get(remote, start, n, remoteHash, check)
+	t.requests += check.requests
+	if err != nil {
+		return err
+	}
+	localHash := sha256.New()
+	if _, err := io.Copy(localHash, io.NewSectionReader(f, int64(start), n)); err != nil {
+		return err
+	}
+	if !bytes.Equal(remoteHash.Sum(nil), localHash.Sum(nil)) {
+		return fmt.Errorf("%s: %w", remote, ErrResumeMismatch)
+	}
+	return nil
+}
+
+// put opens to with pflags and writes r to it starting at offset, returning the number of bytes
+// written
+func (s *Session) put(r io.Reader, to string, offset uint64, pflags uint32, t *transfer) (uint64, error) {
+	id := s.nextSeq()
+	read := s.r.getChan(id)
+	defer s.r.delChan(id)
+	t.request()
+	handle, err := s.OpenFileReq(id, read, to, pflags, Attrs{})
+	if err != nil {
+		return 0, err
+	}
+	written := uint64(0)
+	buf := make([]byte, maxDataLength)
+	for {
+		n, rErr := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := s.limit(t, n); err != nil {
+				_ = s.CloseReq(id, read, handle)
+				return written, err
+			}
+			t.request()
+			if err := s.WriteReq(id, read, handle, offset+written, buf[:n]); err != nil {
+				_ = s.CloseReq(id, read, handle)
+				return written, err
+			}
+			written += uint64(n)
+			t.add(n)
+		}
+		if rErr == io.EOF || rErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rErr != nil {
+			_ = s.CloseReq(id, read, handle)
+			return written, rErr
+		}
+	}
+	if t.fsync {
+		t.request()
+		if err := s.fsync(id, read, handle); err != nil {
+			_ = s.CloseReq(id, read, handle)
+			return written, err
+		}
+	}
+	t.request()
+	// the server may report write errors only when the file is closed
+	return written, s.closeHandle(id, read, handle)
+}
+
+// fsync flushes handle to stable storage with fsync@openssh.com
+func (s *Session) fsync(id uint32, read chan Msg, handle string) error {
+	if !s.hasExtension(extFsync) {
+		return fmt.Errorf("%s: %w", extFsync, errors.ErrUnsupported)
+	}
+	buf := bytes.NewBuffer(nil)
+	_ = WriteString(buf, handle)
+	if err := s.w.write(&ExtendedReq{Header: Header{Id: id}, Request: extFsync, Data: buf.Bytes()}); err != nil {
+		return err
+	}
+	return s.statusReq(read)
+}
+
+// closeHandle closes handle, unlike CloseReq returning an error when the server reports one
+func (s *Session) closeHandle(id uint32, read chan Msg, handle string) error {
+	if err := s.w.write(&CloseReq{Header: Header{Id: id}, Handle: handle}); err != nil {
+		return err
+	}
+	return s.statusReq(read)
+}
+
+// OpenFileReq opens path with the SSH_FXF_ flags pflags, using attrs for a file created
+func (s *Session) OpenFileReq(id uint32, read chan Msg, path string, pflags uint32, attrs Attrs) (string, error) {
+	if err := s.w.write(&OpenReq{Header: Header{Id: id}, Filename: path, Pflags: pflags, Attrs: attrs}); err != nil {
+		return "", err
+	}
+	msg, err := s.recv(read)
+	if err != nil {
+		return "", err
+	}
+	handleResp, statusResp, err := s.handleOrStatusResp(msg)
+	switch {
+	case err != nil:
+		return "", err
+	case statusResp != nil:
+		return "", statusError(statusResp)
+	}
+	return handleResp.Handle, nil
+}
+
+// WriteReq writes data to the file handle at offset
+func (s *Session) WriteReq(id uint32, read chan Msg, handle string, offset uint64, data []byte) error {
+	if err := s.w.write(&WriteReq{Header: Header{Id: id}, Handle: handle, Offset: offset, Data: data}); err != nil {
+		return err
+	}
+	return s.statusReq(read)
+}
+
+// statusReq waits for a StatusResp on read, returning an error unless it is SSH_FX_OK
+func (s *Session) statusReq(read chan Msg) error {
+	msg, err := s.recv(read)
+	if err != nil {
+		return err
+	}
+	switch msg := msg.(type) {
+	case *StatusResp:
+		if msg.ErrorCode != SSH_FX_OK {
+			return statusError(msg)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unhandled message type %T", msg)
+	}
+}
@@ -0,0 +1,123 @@
+package usftp
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// URL is a parsed sftp URL of the form sftp://[user[:password]@]host[:port][/path], see
+// draft-ietf-secsh-scp-sftp-ssh-uri. A path beginning "/~/" is relative to the home directory
+// of the user and is returned without that prefix.
+type URL struct {
+	User     string
+	Password string
+	Host     string
+	Port     int
+	Path     string
+}
+
+// WithSessionOptions configures the Session created by Connect
+func WithSessionOptions(opts ...SessionOption) DialOption {
+	return func(o *dialOptions) {
+		o.sessionOpts = append(o.sessionOpts, opts...)
+	}
+}
+
+// ParseURL parses rawURL. The port defaults to 22, the user to the local user, and the path to
+// ".".
+func ParseURL(rawURL string) (URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return URL{}, err
+	}
+	if u.Scheme != "sftp" {
+		return URL{}, fmt.Errorf("url %s: scheme must be sftp", rawURL)
+	}
+	if u.Hostname() == "" {
+		return URL{}, fmt.Errorf("url %s: missing host", rawURL)
+	}
+	p := URL{Host: u.Hostname(), Port: 22, Path: u.Path}
+	if port := u.Port(); port != "" {
+		if p.Port, err = strconv.Atoi(port); err != nil || p.Port < 1 || p.Port > 65535 {
+			return URL{}, fmt.Errorf("url %s: invalid port", rawURL)
+		}
+	}
+	if u.User != nil {
+		p.User = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+	if p.User == "" {
+		p.User = localUser()
+	}
+	switch {
+	case p.Path == "" || p.Path == "/~" || p.Path == "/~/":
+		p.Path = "."
+	case strings.HasPrefix(p.Path, "/~/"):
+		p.Path = p.Path[3:]
+	}
+	return p, nil
+}
+
+// String returns the URL without the password
+func (u URL) String() string {
+	p := u.Path
+	if !strings.HasPrefix(p, "/") {
+		p = "/~/" + p
+	}
+	v := url.URL{Scheme: "sftp", User: url.User(u.User), Host: hostPort(u.Host, u.Port), Path: p}
+	return v.String()
+}
+
+// Connect dials the host in rawURL and starts a Session, returning it with the path from the
+// URL. Authentication is configured with opts, and a password in the URL is also tried. Closing
+// the Session also closes the ssh.Client. If ctx is done before the Session is ready, dialing
+// stops, the connection is closed and ctx.Err() returned.
+func Connect(ctx context.Context, rawURL string, opts ...DialOption) (*Session, string, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Password != "" {
+		opts = append(opts, WithPassword(u.Password))
+	}
+	opts = append(opts, withContext(ctx))
+	s, err := dialSession(u.User, u.Host, u.Port, "", nil, opts...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		return nil, "", err
+	}
+	// the sftp subsystem may have started as ctx was done
+	if ctx.Err() != nil {
+		_ = s.Close()
+		return nil, "", ctx.Err()
+	}
+	return s, u.Path, nil
+}
+
+// dialSession dials and starts a Session which closes the ssh.Client when closed
+func dialSession(user string, host string, port int, privateKeyPath string, hostKeyCallback ssh.HostKeyCallback, opts ...DialOption) (*Session, error) {
+	c, err := Dial(user, host, port, privateKeyPath, hostKeyCallback, opts...)
+	if err != nil {
+		return nil, err
+	}
+	o := newDialOptions("", opts)
+	if o.ctx != nil {
+		// the handshake is bounded by ctx in Dial, starting the sftp subsystem is bounded here
+		stop := context.AfterFunc(o.ctx, func() { _ = c.Close() })
+		defer stop()
+	}
+	s, err := NewSession(c, o.sessionOpts...)
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	s.addCloser(c)
+	return s, nil
+}
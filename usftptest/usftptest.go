@@ -0,0 +1,487 @@
+// Package usftptest runs an in-process SSH server with an SFTP subsystem on a loopback
+// listener, for integration tests that do not depend on an external server.
+package usftptest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/richardjennings/usftp"
+	"github.com/richardjennings/usftp/server"
+	"golang.org/x/crypto/ssh"
+)
+
+type (
+	// Server is an SSH server listening on 127.0.0.1, serving Handler as the sftp subsystem.
+	// Clients authenticate as User with ClientKey.
+	Server struct {
+		Addr      string
+		Host      string
+		Port      int
+		User      string
+		Handler   server.Handler
+		HostKey   ssh.Signer
+		ClientKey ssh.Signer
+
+		tb          testing.TB
+		clientPEM   []byte
+		seeds       []func(h server.Handler) error
+		commands    []string
+		listener    net.Listener
+		sftp        *server.Server
+		wg          sync.WaitGroup
+		mtx         sync.Mutex
+		conns       map[net.Conn]struct{}
+		authorized  map[string]struct{}
+		authorities map[string]struct{}
+		password    string
+		banner      string
+		stalled     chan struct{}
+		forwarding  bool
+		hostKeys    []ssh.Signer
+	}
+
+	// stallConn blocks reads and writes while the Server is stalled
+	stallConn struct {
+		net.Conn
+		s *Server
+	}
+
+	// Option configures a Server
+	Option func(*Server)
+)
+
+// WithUser sets the user name clients authenticate as, the default is "foo"
+func WithUser(user string) Option {
+	return func(s *Server) {
+		s.User = user
+	}
+}
+
+// WithPassword additionally allows clients to authenticate as User with password, using either
+// the password or the keyboard-interactive method. Keyboard-interactive asks a single question,
+// "Password: ".
+func WithPassword(password string) Option {
+	return func(s *Server) {
+		s.password = password
+	}
+}
+
+// WithBanner sends banner to clients before authentication
+func WithBanner(banner string) Option {
+	return func(s *Server) {
+		s.banner = banner
+	}
+}
+
+// WithHostKey additionally offers key as a host key, so the Server has keys of several types
+func WithHostKey(key ssh.Signer) Option {
+	return func(s *Server) {
+		s.hostKeys = append(s.hostKeys, key)
+	}
+}
+
+// WithForwarding accepts "direct-tcpip" channels, allowing the Server to be used as a jump host
+func WithForwarding() Option {
+	return func(s *Server) {
+		s.forwarding = true
+	}
+}
+
+// WithHandler serves h instead of an empty server.MemHandler
+func WithHandler(h server.Handler) Option {
+	return func(s *Server) {
+		s.Handler = h
+	}
+}
+
+// WithExecCommands additionally serves SFTP for "exec" requests running one of commands, see
+// usftp.WithCommand
+func WithExecCommands(commands ...string) Option {
+	return func(s *Server) {
+		s.commands = append(s.commands, commands...)
+	}
+}
+
+// WithFile seeds the file name with data, creating parent directories as needed
+func WithFile(name string, data string) Option {
+	return func(s *Server) {
+		s.seeds = append(s.seeds, func(h server.Handler) error {
+			return writeFile(h, name, []byte(data))
+		})
+	}
+}
+
+// WithFS seeds the directory dir with the contents of fsys. Directories are created with mode
+// 0755 and files with mode 0644.
+func WithFS(dir string, fsys fs.FS) Option {
+	return func(s *Server) {
+		s.seeds = append(s.seeds, func(h server.Handler) error {
+			return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				name := path.Join("/", dir, p)
+				if d.IsDir() {
+					return mkdirAll(h, name)
+				}
+				b, err := fs.ReadFile(fsys, p)
+				if err != nil {
+					return err
+				}
+				return writeFile(h, name, b)
+			})
+		})
+	}
+}
+
+// NewServer starts a Server which is closed when the test completes. Errors fail the test.
+func NewServer(tb testing.TB, opts ...Option) *Server {
+	tb.Helper()
+	s := &Server{
+		User:        "foo",
+		tb:          tb,
+		conns:       make(map[net.Conn]struct{}),
+		authorized:  make(map[string]struct{}),
+		authorities: make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.Handler == nil {
+		s.Handler = server.NewMemHandler()
+	}
+	for _, seed := range s.seeds {
+		if err := seed(s.Handler); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := s.start(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func (s *Server) start() error {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if s.HostKey, err = ssh.NewSignerFromKey(hostKey); err != nil {
+		return err
+	}
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if s.ClientKey, err = ssh.NewSignerFromKey(clientKey); err != nil {
+		return err
+	}
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		return err
+	}
+	s.clientPEM = pem.EncodeToMemory(block)
+	s.Authorize(s.ClientKey.PublicKey())
+
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.Addr = s.listener.Addr().String()
+	host, port, _ := net.SplitHostPort(s.Addr)
+	s.Host = host
+	s.Port, _ = strconv.Atoi(port)
+	s.sftp = server.New(s.Handler, server.WithExecCommands(s.commands...))
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.accept()
+	}()
+	return nil
+}
+
+// Authorize allows clients to authenticate as User with the key pub
+func (s *Server) Authorize(pub ssh.PublicKey) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.authorized[string(pub.Marshal())] = struct{}{}
+}
+
+// TrustUserCA allows clients to authenticate as User with a certificate signed by ca
+func (s *Server) TrustUserCA(ca ssh.PublicKey) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.authorities[string(ca.Marshal())] = struct{}{}
+}
+
+func (s *Server) config() *ssh.ServerConfig {
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			_, ok := s.authorities[string(auth.Marshal())]
+			return ok
+		},
+		UserKeyFallback: func(c ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			if _, ok := s.authorized[string(pub.Marshal())]; ok {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		},
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() != s.User {
+				return nil, errors.New("unauthorized")
+			}
+			return checker.Authenticate(c, pub)
+		},
+	}
+	if s.password != "" {
+		config.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == s.User && string(password) == s.password {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		}
+		config.KeyboardInteractiveCallback = func(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge(c.User(), "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+			if c.User() == s.User && len(answers) == 1 && answers[0] == s.password {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized")
+		}
+	}
+	if s.banner != "" {
+		config.BannerCallback = func(ssh.ConnMetadata) string {
+			return s.banner
+		}
+	}
+	config.AddHostKey(s.HostKey)
+	for _, k := range s.hostKeys {
+		config.AddHostKey(k)
+	}
+	return config
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		conn = &stallConn{Conn: conn, s: s}
+		s.mtx.Lock()
+		s.conns[conn] = struct{}{}
+		s.mtx.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serve(conn)
+			s.mtx.Lock()
+			delete(s.conns, conn)
+			s.mtx.Unlock()
+		}()
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config())
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	if !s.forwarding {
+		s.sftp.ServeChannels(chans)
+		return
+	}
+	sessions := make(chan ssh.NewChannel)
+	defer close(sessions)
+	go s.sftp.ServeChannels(sessions)
+	for nc := range chans {
+		if nc.ChannelType() == "direct-tcpip" {
+			go s.forward(nc)
+			continue
+		}
+		sessions <- nc
+	}
+}
+
+// forward connects a "direct-tcpip" channel to the address it requests
+func (s *Server) forward(nc ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &target); err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		_, _ = io.Copy(ch, conn)
+		_ = ch.CloseWrite()
+	}()
+	_, _ = io.Copy(conn, ch)
+	_ = conn.Close()
+	_ = ch.Close()
+}
+
+// HostKeyCallback accepts only the host key of the Server
+func (s *Server) HostKeyCallback() ssh.HostKeyCallback {
+	return ssh.FixedHostKey(s.HostKey.PublicKey())
+}
+
+// ClientKeyFile writes the private key of ClientKey to a temporary file and returns its path
+func (s *Server) ClientKeyFile() string {
+	s.tb.Helper()
+	p := filepath.Join(s.tb.TempDir(), "id_ed25519")
+	if err := os.WriteFile(p, s.clientPEM, 0600); err != nil {
+		s.tb.Fatal(err)
+	}
+	return p
+}
+
+// Client returns a new authenticated ssh.Client, closed when the test completes
+func (s *Server) Client() *ssh.Client {
+	s.tb.Helper()
+	c, err := ssh.Dial("tcp", s.Addr, &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(s.ClientKey)},
+		HostKeyCallback: s.HostKeyCallback(),
+	})
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	s.tb.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// Session returns a new usftp.Session on its own ssh.Client, closed when the test completes
+func (s *Server) Session(opts ...usftp.SessionOption) *usftp.Session {
+	s.tb.Helper()
+	session, err := usftp.NewSession(s.Client(), opts...)
+	if err != nil {
+		s.tb.Fatal(err)
+	}
+	s.tb.Cleanup(func() { _ = session.Close() })
+	return session
+}
+
+// DropConnections closes all open connections, as when the network fails, leaving the Server
+// accepting new ones
+func (s *Server) DropConnections() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// Stall stops the Server from reading from or writing to connections, as when the network or
+// the host goes away without closing them, until Close
+func (s *Server) Stall() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.stalled == nil {
+		s.stalled = make(chan struct{})
+	}
+}
+
+// wait blocks while the Server is stalled
+func (s *Server) wait() {
+	s.mtx.Lock()
+	stalled := s.stalled
+	s.mtx.Unlock()
+	if stalled != nil {
+		<-stalled
+	}
+}
+
+func (c *stallConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.s.wait()
+	return n, err
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	c.s.wait()
+	return c.Conn.Write(b)
+}
+
+// Close stops the listener and closes all connections
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mtx.Lock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	if s.stalled != nil {
+		close(s.stalled)
+		s.stalled = nil
+	}
+	s.mtx.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func mkdirAll(h server.Handler, name string) error {
+	if name == "/" {
+		return nil
+	}
+	if _, err := h.Stat(name); err == nil {
+		return nil
+	}
+	if err := mkdirAll(h, path.Dir(name)); err != nil {
+		return err
+	}
+	return h.Mkdir(name, usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_PERMISSIONS, Permissions: 0755})
+}
+
+func writeFile(h server.Handler, name string, data []byte) error {
+	name = path.Join("/", name)
+	if err := mkdirAll(h, path.Dir(name)); err != nil {
+		return err
+	}
+	f, err := h.Open(name, usftp.SSH_FXF_WRITE|usftp.SSH_FXF_CREAT|usftp.SSH_FXF_TRUNC, usftp.Attrs{Flags: usftp.SSH_FILEXFER_ATTR_PERMISSIONS, Permissions: 0644})
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -2,33 +2,90 @@ package usftp
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"sync"
+	"sync/atomic"
 )
 
 type (
 	writer struct {
-		w io.Writer
+		// mtx keeps packets written by concurrent requests from interleaving
+		mtx sync.Mutex
+		w   io.Writer
+		ctx context.Context
+		// r reports the error which stopped the Session
+		r *reader
+		// closed is set by Session.Close
+		closed atomic.Bool
 	}
 )
 
+// write sends m, distinguishing a failed transport from a Session which has been closed
 func (w *writer) write(m Msg) error {
+	b, err := marshalMsg(m)
+	if err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if err := w.stopped(); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(b); err != nil {
+		if err := w.stopped(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	}
+	return nil
+}
+
+// stopped returns ErrSessionClosed once the Session is closed, the error which stopped the
+// reader, or nil
+func (w *writer) stopped() error {
+	if w.closed.Load() {
+		return ErrSessionClosed
+	}
+	select {
+	case <-w.r.done:
+		return w.r.err
+	default:
+	}
+	if w.ctx.Err() != nil {
+		return ErrSessionClosed
+	}
+	return nil
+}
+
+// WriteMsg encodes m as a single packet and writes it to w with one call to Write
+func WriteMsg(w io.Writer, m Msg) error {
+	b, err := marshalMsg(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func marshalMsg(m Msg) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 	payload, err := m.MarshalBinary()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	l := uint32(len(payload)) + 1
 	if err := WriteUint32(buf, l); err != nil {
-		return err
+		return nil, err
 	}
 	t, err := TypeId(m)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if err := WriteUint8(buf, t); err != nil {
-		return err
+		return nil, err
 	}
 	buf.Write(payload)
-	_, err = w.w.Write(buf.Bytes())
-	return err
+	return buf.Bytes(), nil
 }